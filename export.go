@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+// content type of the GPX export
+const gpxContentType = "application/gpx+xml"
+
+// GPX 1.1 document, see http://www.topografix.com/GPX/1/1/
+type gpxDocument struct {
+	XMLName   xml.Name      `xml:"http://www.topografix.com/GPX/1/1 gpx"`
+	Version   string        `xml:"version,attr"`
+	Creator   string        `xml:"creator,attr"`
+	Metadata  gpxMetadata   `xml:"metadata"`
+	Waypoints []gpxWaypoint `xml:"wpt"`
+	Track     gpxTrack      `xml:"trk"`
+}
+
+type gpxMetadata struct {
+	Name   string     `xml:"name"`
+	Desc   string     `xml:"desc,omitempty"`
+	Author *gpxPerson `xml:"author,omitempty"`
+	Time   *time.Time `xml:"time,omitempty"`
+}
+
+type gpxPerson struct {
+	Name string `xml:"name"`
+}
+
+type gpxWaypoint struct {
+	Lat  float64    `xml:"lat,attr"`
+	Lon  float64    `xml:"lon,attr"`
+	Ele  *int64     `xml:"ele,omitempty"`
+	Time *time.Time `xml:"time,omitempty"`
+	Name string     `xml:"name,omitempty"`
+	Desc string     `xml:"desc,omitempty"`
+}
+
+type gpxTrack struct {
+	Name    string        `xml:"name"`
+	Segment []gpxWaypoint `xml:"trkseg>trkpt"`
+}
+
+// Builds the GPX document of a track: its fixes as one track segment, and
+// the declared task as waypoints
+func newGPX(track igc.Track, fields igcFields) gpxDocument {
+	name := trackName(fields)
+	doc := gpxDocument{
+		Version:   "1.1",
+		Creator:   "igcglider",
+		Metadata:  gpxMetadata{Name: name, Desc: gliderName(fields)},
+		Waypoints: make([]gpxWaypoint, 0),
+		Track:     gpxTrack{Name: name, Segment: make([]gpxWaypoint, len(track.Points))},
+	}
+	if fields.Pilot != "" {
+		doc.Metadata.Author = &gpxPerson{fields.Pilot}
+	}
+
+	for i, p := range track.Points {
+		t := p.Time
+		ele := p.GNSSAltitude
+		doc.Track.Segment[i] = gpxWaypoint{Lat: p.Lat.Degrees(), Lon: p.Lng.Degrees(), Ele: &ele, Time: &t}
+	}
+	if len(track.Points) > 0 {
+		doc.Metadata.Time = doc.Track.Segment[0].Time
+	}
+
+	for _, p := range taskWaypoints(track.Task) {
+		doc.Waypoints = append(doc.Waypoints, gpxWaypoint{
+			Lat:  p.Lat.Degrees(),
+			Lon:  p.Lng.Degrees(),
+			Name: strings.TrimSpace(p.Description),
+		})
+	}
+	return doc
+}
+
+// Returns the points of the declared task, from takeoff to landing,
+// leaving out those the recorder left blank
+func taskWaypoints(task igc.Task) []igc.Point {
+	points := []igc.Point{task.Takeoff, task.Start}
+	points = append(points, task.Turnpoints...)
+	points = append(points, task.Finish, task.Landing)
+
+	waypoints := make([]igc.Point, 0, len(points))
+	for _, p := range points {
+		if p.Lat != 0 || p.Lng != 0 {
+			waypoints = append(waypoints, p)
+		}
+	}
+	return waypoints
+}
+
+// Names a track after its pilot and date, for the exports
+func trackName(fields igcFields) string {
+	name := fmt.Sprintf("Track %d", fields.TrackID)
+	if fields.Pilot != "" {
+		name = fields.Pilot
+	}
+	if !fields.HDate.IsZero() {
+		name += " " + fields.HDate.Format("2006-01-02")
+	}
+	return name
+}
+
+// Describes the glider of a track, type and registration
+func gliderName(fields igcFields) string {
+	switch {
+	case fields.GliderID == "":
+		return fields.Glider
+	case fields.Glider == "":
+		return fields.GliderID
+	default:
+		return fields.Glider + " (" + fields.GliderID + ")"
+	}
+}
+
+// Sets the headers of a file download named after the track
+func attachment(w http.ResponseWriter, fields igcFields, contentType string, ext string) {
+	http.Header.Add(w.Header(), "content-type", contentType)
+	http.Header.Add(w.Header(), "content-disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fmt.Sprintf("%d.%s", fields.TrackID, ext)}))
+}
+
+// GET api/track/<id>/gpx exports the track as GPX 1.1
+func (s *server) gpxHandler(w http.ResponseWriter, r *http.Request, fields igcFields) {
+	track, ok := s.loadTrack(w, fields)
+	if !ok {
+		return
+	}
+	doc := newGPX(track, fields)
+
+	attachment(w, fields, gpxContentType, "gpx")
+	_, _ = w.Write([]byte(xml.Header))
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(&doc); err != nil {
+		log.Printf("could not send gpx of track %d: %v", fields.TrackID, err)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+func TestTrackGPX(t *testing.T) {
+	srv := newTestServer()
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	id := uploadFlight(t, ts.URL, "testdata/flight.igc")
+	resp, err := http.Get(ts.URL + root + "/api/track/" + strconv.Itoa(id) + "/gpx")
+	if err != nil {
+		t.Fatalf("Error creating the GET request, %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the gpx file, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("content-type"); ct != gpxContentType {
+		t.Errorf("Expected content type %s, got %s", gpxContentType, ct)
+	}
+	if cd := resp.Header.Get("content-disposition"); cd != "attachment; filename="+strconv.Itoa(id)+".gpx" {
+		t.Errorf("Unexpected content disposition %s", cd)
+	}
+	if !strings.HasPrefix(string(body), `<?xml version="1.0" encoding="UTF-8"?>`) {
+		t.Errorf("Expected an XML declaration, got %.40s", body)
+	}
+
+	doc := struct {
+		XMLName  xml.Name
+		Version  string `xml:"version,attr"`
+		Metadata struct {
+			Name   string `xml:"name"`
+			Desc   string `xml:"desc"`
+			Author string `xml:"author>name"`
+		} `xml:"metadata"`
+		Waypoints []struct {
+			Name string `xml:"name"`
+		} `xml:"wpt"`
+		Points []struct {
+			Lat  float64   `xml:"lat,attr"`
+			Lon  float64   `xml:"lon,attr"`
+			Ele  float64   `xml:"ele"`
+			Time time.Time `xml:"time"`
+		} `xml:"trk>trkseg>trkpt"`
+	}{}
+	if err = xml.Unmarshal(body, &doc); err != nil {
+		t.Fatalf("Error decoding gpx, %s", err)
+	}
+
+	if doc.XMLName.Space != "http://www.topografix.com/GPX/1/1" || doc.XMLName.Local != "gpx" || doc.Version != "1.1" {
+		t.Errorf("Expected a GPX 1.1 document, got %v version %s", doc.XMLName, doc.Version)
+	}
+	if doc.Metadata.Author != "Jane Doe" || doc.Metadata.Desc != "Ozone Delta 3 (NO-1234)" {
+		t.Errorf("Unexpected metadata %+v", doc.Metadata)
+	}
+	names := make([]string, 0)
+	for _, w := range doc.Waypoints {
+		names = append(names, w.Name)
+	}
+	if strings.Join(names, ",") != "TAKEOFF,START,TP1,TP2,FINISH,LANDING" {
+		t.Errorf("Unexpected waypoints %v", names)
+	}
+
+	if len(doc.Points) != 2206 {
+		t.Fatalf("Expected every fix, got %d", len(doc.Points))
+	}
+	first := doc.Points[0]
+	if want := time.Date(2018, 8, 16, 10, 0, 0, 0, time.UTC); !first.Time.Equal(want) {
+		t.Errorf("Expected the first fix at %v, got %v", want, first.Time)
+	}
+	if first.Lat < 45.99 || first.Lat > 46.01 || first.Lon < 7.99 || first.Lon > 8.01 || first.Ele < 990 || first.Ele > 1010 {
+		t.Errorf("Unexpected first fix %+v", first)
+	}
+}
+
+// the parts of a KML document checked by the tests
+type testKML struct {
+	XMLName  xml.Name
+	Document struct {
+		Name    string `xml:"name"`
+		Folders []struct {
+			Name       string          `xml:"name"`
+			Placemarks []testPlacemark `xml:"Placemark"`
+		} `xml:"Folder"`
+		Placemarks []testPlacemark `xml:"Placemark"`
+	} `xml:"Document"`
+}
+
+type testPlacemark struct {
+	Name       string `xml:"name"`
+	StyleURL   string `xml:"styleUrl"`
+	LineString struct {
+		Extrude      int    `xml:"extrude"`
+		AltitudeMode string `xml:"altitudeMode"`
+		Coordinates  string `xml:"coordinates"`
+	}
+}
+
+// Gets a track export and checks its content type
+func getExport(t *testing.T, url string, contentType string) []byte {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Error creating the GET request, %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the export, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("content-type"); ct != contentType {
+		t.Errorf("Expected content type %s, got %s", contentType, ct)
+	}
+	return body
+}
+
+func TestTrackKML(t *testing.T) {
+	srv := newTestServer()
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	id := uploadFlight(t, ts.URL, "testdata/flight.igc")
+	trackURL := ts.URL + root + "/api/track/" + strconv.Itoa(id)
+
+	body := getExport(t, trackURL+"/kml", kmlContentType)
+	doc := testKML{}
+	if err := xml.Unmarshal(body, &doc); err != nil {
+		t.Fatalf("Error decoding kml, %s", err)
+	}
+	if doc.XMLName.Space != "http://www.opengis.net/kml/2.2" || doc.Document.Name != "Jane Doe 2018-08-16" {
+		t.Errorf("Unexpected document %v %q", doc.XMLName, doc.Document.Name)
+	}
+	if len(doc.Document.Folders) != 2 {
+		t.Fatalf("Expected the path and thermal folders, got %d", len(doc.Document.Folders))
+	}
+
+	path := doc.Document.Folders[0].Placemarks
+	if len(path) != 1 || path[0].LineString.Extrude != 1 || path[0].LineString.AltitudeMode != "absolute" {
+		t.Fatalf("Expected one extruded absolute line, got %+v", path)
+	}
+	coordinates := strings.Fields(path[0].LineString.Coordinates)
+	if len(coordinates) != 2206 {
+		t.Errorf("Expected every fix in the path, got %d", len(coordinates))
+	}
+	if coordinates[0] != "8.000000,46.000017,999" {
+		t.Errorf("Expected lng,lat,alt coordinates, got %s", coordinates[0])
+	}
+
+	if thermals := doc.Document.Folders[1].Placemarks; len(thermals) != 3 {
+		t.Errorf("Expected 3 thermals, got %d", len(thermals))
+	}
+	names := make([]string, 0)
+	for _, p := range doc.Document.Placemarks {
+		names = append(names, p.Name)
+	}
+	if strings.Join(names, ",") != "Takeoff,Landing" {
+		t.Errorf("Expected takeoff and landing placemarks, got %v", names)
+	}
+
+	// by climb rate, the path is split in stretches of the same colour
+	doc = testKML{}
+	if err := xml.Unmarshal(getExport(t, trackURL+"/kml?colour=climb", kmlContentType), &doc); err != nil {
+		t.Fatalf("Error decoding kml, %s", err)
+	}
+	path = doc.Document.Folders[0].Placemarks
+	if len(path) < 5 {
+		t.Fatalf("Expected the path in several colours, got %d", len(path))
+	}
+	fixes := 0
+	for _, p := range path {
+		if !strings.HasPrefix(p.StyleURL, "#climb") {
+			t.Errorf("Unexpected style %s", p.StyleURL)
+		}
+		fixes += len(strings.Fields(p.LineString.Coordinates)) - 1
+	}
+	if fixes != 2205 {
+		t.Errorf("Expected the stretches to cover the path, got %d fixes", fixes+1)
+	}
+
+	// the same document, zipped
+	archive := getExport(t, trackURL+"/kmz", kmzContentType)
+	z, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("Error opening kmz, %s", err)
+	}
+	if len(z.File) != 1 || z.File[0].Name != "doc.kml" {
+		t.Fatalf("Expected doc.kml in the kmz, got %d files", len(z.File))
+	}
+	f, _ := z.File[0].Open()
+	kml, _ := ioutil.ReadAll(f)
+	f.Close()
+	if !bytes.Equal(kml, body) {
+		t.Error("Expected the kmz to hold the kml document")
+	}
+}
+
+func TestKMLThermalAltitude(t *testing.T) {
+	// the barometer reads 500m below the GPS: the thermals are placed at
+	// the absolute altitude of the path
+	track := parseTestFlight(t, "testdata/flight.igc")
+	for i := range track.Points {
+		track.Points[i].PressureAltitude = track.Points[i].GNSSAltitude - 500
+	}
+	doc := newKML(track, 1, false)
+	thermals := detectThermals(track.Points, airborneSegments(track.Points))
+	placemarks := doc.Document.Folders[1].Placemarks
+	if len(placemarks) != len(thermals) || len(thermals) == 0 {
+		t.Fatalf("Expected a placemark for each of the %d thermals, got %d", len(thermals), len(placemarks))
+	}
+	for i, th := range thermals {
+		want := strconv.FormatInt(track.Points[th.last].GNSSAltitude, 10)
+		if c := placemarks[i].Point.Coordinates; !strings.HasSuffix(c, ","+want) {
+			t.Errorf("Expected thermal %d at %sm, got %s", i+1, want, c)
+		}
+	}
+}
+
+func TestEncodeFlight(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/flight.igc")
+	if err != nil {
+		t.Fatalf("Error reading test flight, %s", err)
+	}
+	track, err := igc.Parse(string(content))
+	if err != nil {
+		t.Fatalf("Error parsing test flight, %s", err)
+	}
+
+	encoded := &bytes.Buffer{}
+	if err = igc.Encode(encoded, track); err != nil {
+		t.Fatalf("Error encoding test flight, %s", err)
+	}
+	again, err := igc.Parse(encoded.String())
+	if err != nil {
+		t.Fatalf("Error parsing the encoded flight, %s", err)
+	}
+	if !reflect.DeepEqual(track, again) {
+		t.Error("Expected the encoded flight to parse to the same track")
+	}
+	fp := func(track igc.Track) string {
+		return fingerprint(track.Header, track.Points[0], track.Points[len(track.Points)-1])
+	}
+	if fp(track) != fp(again) {
+		t.Error("Expected the encoded flight to have the same fingerprint")
+	}
+}
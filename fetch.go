@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// fetch error codes, returned to the client in the "error" field
+const (
+	fetchInvalidURL       = "invalid_url"
+	fetchBadScheme        = "unsupported_scheme"
+	fetchForbiddenAddress = "forbidden_address"
+	fetchTooManyRedirects = "too_many_redirects"
+	fetchTimeout          = "timeout"
+	fetchTooLarge         = "too_large"
+	fetchBadStatus        = "bad_status"
+	fetchFailed           = "fetch_failed"
+)
+
+// fetchError is returned by the fetcher, Code tells what went wrong
+type fetchError struct {
+	Code string
+	Err  error
+}
+
+func (e *fetchError) Error() string {
+	return e.Code + ": " + e.Err.Error()
+}
+
+// HTTP status the API answers with when a fetch fails
+func (e *fetchError) status() int {
+	switch e.Code {
+	case fetchInvalidURL, fetchBadScheme, fetchForbiddenAddress:
+		return http.StatusBadRequest
+	case fetchTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case fetchTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// fetchConfig holds the limits applied when downloading a track
+type fetchConfig struct {
+	Timeout      time.Duration
+	MaxBytes     int64
+	MaxRedirects int
+	// AllowPrivate lifts the address check, for tests against local servers
+	AllowPrivate bool
+}
+
+// Default limits, overridden by $FETCH_TIMEOUT, $FETCH_MAX_BYTES and
+// $FETCH_MAX_REDIRECTS
+func fetchConfigFromEnv() (fetchConfig, error) {
+	config := fetchConfig{
+		Timeout:      15 * time.Second,
+		MaxBytes:     maxUploadSize,
+		MaxRedirects: 5,
+	}
+
+	var err error
+	if v := os.Getenv("FETCH_TIMEOUT"); v != "" {
+		if config.Timeout, err = time.ParseDuration(v); err != nil {
+			return config, fmt.Errorf("invalid $FETCH_TIMEOUT: %v", err)
+		}
+	}
+	if v := os.Getenv("FETCH_MAX_BYTES"); v != "" {
+		if config.MaxBytes, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return config, fmt.Errorf("invalid $FETCH_MAX_BYTES: %v", err)
+		}
+	}
+	if v := os.Getenv("FETCH_MAX_REDIRECTS"); v != "" {
+		if config.MaxRedirects, err = strconv.Atoi(v); err != nil {
+			return config, fmt.Errorf("invalid $FETCH_MAX_REDIRECTS: %v", err)
+		}
+	}
+	return config, nil
+}
+
+// fetcher downloads IGC files submitted by URL. Only http and https are
+// allowed, and connections to loopback, private and link-local addresses
+// are refused after DNS resolution, so a redirect or a rebinding DNS name
+// can't reach internal services either.
+type fetcher struct {
+	client   *http.Client
+	maxBytes int64
+}
+
+func newFetcher(config fetchConfig) *fetcher {
+	dialer := &net.Dialer{Timeout: config.Timeout}
+	if !config.AllowPrivate {
+		dialer.Control = checkAddress
+	}
+
+	transport := &http.Transport{
+		Proxy:               nil,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: config.Timeout,
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   config.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > config.MaxRedirects {
+				return &fetchError{fetchTooManyRedirects, fmt.Errorf("stopped after %d redirects", config.MaxRedirects)}
+			}
+			return checkScheme(req.URL)
+		},
+	}
+
+	return &fetcher{client: client, maxBytes: config.MaxBytes}
+}
+
+// Downloads the IGC file a submission points to
+func (f *fetcher) Fetch(rawURL string) (submission, error) {
+	sub := submission{URL: rawURL}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return sub, &fetchError{fetchInvalidURL, err}
+	}
+	if u.Host == "" {
+		return sub, &fetchError{fetchInvalidURL, fmt.Errorf("no host in %q", rawURL)}
+	}
+	if err = checkScheme(u); err != nil {
+		return sub, err
+	}
+
+	resp, err := f.client.Get(u.String())
+	if err != nil {
+		return sub, classifyFetchError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return sub, &fetchError{fetchBadStatus, fmt.Errorf("server answered %s", resp.Status)}
+	}
+	if resp.ContentLength > f.maxBytes {
+		return sub, &fetchError{fetchTooLarge, fmt.Errorf("file is %d bytes, limit is %d", resp.ContentLength, f.maxBytes)}
+	}
+
+	// read one byte past the limit to tell a full file from a cut one
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.maxBytes+1))
+	if err != nil {
+		return sub, classifyFetchError(err)
+	}
+	if int64(len(content)) > f.maxBytes {
+		return sub, &fetchError{fetchTooLarge, fmt.Errorf("file exceeds %d bytes", f.maxBytes)}
+	}
+
+	sub.Content = content
+	sub.Name = path.Base(resp.Request.URL.Path)
+	return sub, nil
+}
+
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return &fetchError{fetchBadScheme, fmt.Errorf("scheme %q is not allowed", u.Scheme)}
+	}
+	return nil
+}
+
+// Dialer hook refusing connections to addresses inside our own network
+func checkAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return &fetchError{fetchForbiddenAddress, err}
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || forbiddenIP(ip) {
+		return &fetchError{fetchForbiddenAddress, fmt.Errorf("address %s is not allowed", host)}
+	}
+	return nil
+}
+
+// carrier-grade NAT range, not covered by net.IP.IsPrivate
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func forbiddenIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// Maps an error from the HTTP client to a fetchError
+func classifyFetchError(err error) error {
+	var fe *fetchError
+	if errors.As(err, &fe) {
+		return fe
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return &fetchError{fetchTimeout, err}
+	}
+	return &fetchError{fetchFailed, err}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetcher(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/flight.igc")
+	if err != nil {
+		t.Fatalf("Error reading test flight, %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/flight.igc", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	})
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	local := newFetcher(fetchConfig{Timeout: 200 * time.Millisecond, MaxBytes: maxUploadSize, MaxRedirects: 3, AllowPrivate: true})
+
+	sub, err := local.Fetch(ts.URL + "/flight.igc")
+	if err != nil {
+		t.Fatalf("Error fetching the test flight, %s", err)
+	}
+	if sub.Name != "flight.igc" || len(sub.Content) != len(content) {
+		t.Errorf("Unexpected submission %s with %d bytes", sub.Name, len(sub.Content))
+	}
+
+	small := newFetcher(fetchConfig{Timeout: time.Second, MaxBytes: 100, MaxRedirects: 3, AllowPrivate: true})
+	guarded := newFetcher(fetchConfig{Timeout: time.Second, MaxBytes: maxUploadSize, MaxRedirects: 3})
+
+	cases := []struct {
+		fetcher *fetcher
+		url     string
+		code    string
+	}{
+		{local, "/etc/passwd", fetchInvalidURL},
+		{local, "file:///etc/passwd", fetchInvalidURL},
+		{local, "ftp://example.com/flight.igc", fetchBadScheme},
+		{local, ts.URL + "/file", fetchBadScheme},
+		{local, ts.URL + "/loop", fetchTooManyRedirects},
+		{local, ts.URL + "/slow", fetchTimeout},
+		{local, ts.URL + "/missing", fetchBadStatus},
+		{small, ts.URL + "/flight.igc", fetchTooLarge},
+		{guarded, ts.URL + "/flight.igc", fetchForbiddenAddress},
+		{guarded, "http://169.254.169.254/latest/meta-data/", fetchForbiddenAddress},
+		{guarded, "http://[::1]:80/", fetchForbiddenAddress},
+	}
+
+	for _, c := range cases {
+		_, err := c.fetcher.Fetch(c.url)
+		fe, ok := err.(*fetchError)
+		if !ok {
+			t.Errorf("%s: expected a fetchError, got %v", c.url, err)
+			continue
+		}
+		if fe.Code != c.code {
+			t.Errorf("%s: expected %s, got %s", c.url, c.code, fe)
+		}
+	}
+}
+
+func TestForbiddenIP(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.1.1", "100.64.0.1", "0.0.0.0", "::1", "fe80::1", "fd00::1"} {
+		if !forbiddenIP(net.ParseIP(addr)) {
+			t.Errorf("Expected %s to be forbidden", addr)
+		}
+	}
+	for _, addr := range []string{"8.8.8.8", "151.101.1.1", "2001:4860:4860::8888"} {
+		if forbiddenIP(net.ParseIP(addr)) {
+			t.Errorf("Expected %s to be allowed", addr)
+		}
+	}
+}
+
+func TestFetchErrorResponse(t *testing.T) {
+	srv := newTestServer()
+	srv.fetcher = newFetcher(fetchConfig{Timeout: time.Second, MaxBytes: maxUploadSize})
+	ts := httptest.NewServer(http.HandlerFunc(srv.inputHandler))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL, "application/json", strings.NewReader(`{"url": "`+ts.URL+`"}`))
+	if err != nil {
+		t.Fatalf("Error creating the POST request, %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), fetchForbiddenAddress) {
+		t.Errorf("Expected %s, got %d %s", fetchForbiddenAddress, resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+// thresholds of the flight phase detector
+const (
+	// a fix is airborne when the glider moves faster than this (km/h)...
+	airborneSpeed = 15.0
+	// ...or climbs or sinks faster than this (m/s)
+	airborneVario = 1.5
+	// shorter airborne stretches are GPS jumps or running on launch
+	minAirborne = 30 * time.Second
+	// shorter ground stretches are slow flight, e.g. soaring into the wind
+	minGround = 60 * time.Second
+)
+
+// flightSegment is an airborne part of a track, as the indexes of its
+// takeoff and landing fixes
+type flightSegment struct {
+	Takeoff int
+	Landing int
+}
+
+// Finds the flights in a track. Fixes are airborne while ground speed or
+// vertical speed over rateWindow is above the thresholds, and only
+// stretches lasting minAirborne count as a flight. Flights separated by
+// less than minGround are merged.
+func detectFlights(points []igc.Point) []flightSegment {
+	flights := make([]flightSegment, 0)
+	if len(points) < 2 {
+		return flights
+	}
+
+	alt := altitudes(points)
+	airborne := make([]bool, len(points))
+	for i := range points {
+		from, to := rateSpan(points, i)
+		seconds := points[to].Time.Sub(points[from].Time).Seconds()
+		if seconds <= 0 {
+			continue
+		}
+		speed := points[from].Distance(points[to]) / (seconds / 3600)
+		vario := (alt[to] - alt[from]) / seconds
+		airborne[i] = speed > airborneSpeed || math.Abs(vario) > airborneVario
+	}
+
+	// runs of airborne fixes
+	runs := make([]flightSegment, 0)
+	for i := 0; i < len(points); i++ {
+		if !airborne[i] {
+			continue
+		}
+		start := i
+		for i+1 < len(points) && airborne[i+1] {
+			i++
+		}
+		runs = append(runs, flightSegment{start, i})
+	}
+
+	// merge runs separated by short ground stretches
+	for _, run := range runs {
+		if n := len(flights); n > 0 && points[run.Takeoff].Time.Sub(points[flights[n-1].Landing].Time) < minGround {
+			flights[n-1].Landing = run.Landing
+			continue
+		}
+		flights = append(flights, run)
+	}
+
+	// drop what is too short to be a flight
+	long := flights[:0]
+	for _, f := range flights {
+		if points[f.Landing].Time.Sub(points[f.Takeoff].Time) >= minAirborne {
+			long = append(long, f)
+		}
+	}
+	return long
+}
+
+// Returns the span of fixes used for the rates at fix i: from i to the
+// first fix at least rateWindow later, or up to i near the end of the track
+func rateSpan(points []igc.Point, i int) (int, int) {
+	for j := i + 1; j < len(points); j++ {
+		if points[j].Time.Sub(points[i].Time) >= rateWindow {
+			return i, j
+		}
+	}
+	for j := i - 1; j >= 0; j-- {
+		if points[i].Time.Sub(points[j].Time) >= rateWindow {
+			return j, i
+		}
+	}
+	return 0, len(points) - 1
+}
+
+// Returns the airborne parts of a track. When no flight is detected the
+// whole track is used, so short or sparse recordings still get statistics.
+func airborneSegments(points []igc.Point) []flightSegment {
+	flights := detectFlights(points)
+	if len(flights) == 0 && len(points) > 0 {
+		flights = append(flights, flightSegment{0, len(points) - 1})
+	}
+	return flights
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+// Builds a track from legs of constant ground speed (m/s) and vario (m/s),
+// with one fix every two seconds
+func syntheticTrack(legs ...[3]float64) []igc.Point {
+	points := make([]igc.Point, 0)
+	t := time.Date(0, 1, 1, 10, 0, 0, 0, time.UTC)
+	lat, alt := 46.0, 1000.0
+	for _, leg := range legs {
+		seconds, speed, vario := leg[0], leg[1], leg[2]
+		for s := 0.0; s < seconds; s += 2 {
+			p := igc.NewPointFromLatLng(lat, 8.0)
+			p.Time = t
+			p.PressureAltitude = int64(alt)
+			p.GNSSAltitude = int64(alt)
+			points = append(points, p)
+
+			t = t.Add(2 * time.Second)
+			lat += speed * 2 / 111195 // metres to degrees of latitude
+			alt += vario * 2
+		}
+	}
+	return points
+}
+
+func TestDetectFlights(t *testing.T) {
+	cases := []struct {
+		name    string
+		legs    [][3]float64
+		flights int
+	}{
+		{"ground only", [][3]float64{{600, 0.5, 0}}, 0},
+		{"one flight", [][3]float64{{120, 0.5, 0}, {600, 10, -1}, {120, 0, 0}}, 1},
+		{"two flights", [][3]float64{{120, 0.5, 0}, {300, 10, -1}, {300, 0, 0}, {300, 10, 2}, {120, 0, 0}}, 2},
+		{"short hop", [][3]float64{{120, 0.5, 0}, {20, 10, 0}, {120, 0.5, 0}}, 0},
+		{"slow soaring", [][3]float64{{120, 0.5, 0}, {300, 10, 0}, {40, 1, 0}, {300, 10, 0}, {120, 0, 0}}, 1},
+		{"thermalling in strong wind", [][3]float64{{120, 0, 0}, {300, 10, 0}, {300, 1, 2}, {300, 10, -1}, {120, 0, 0}}, 1},
+	}
+
+	for _, c := range cases {
+		flights := detectFlights(syntheticTrack(c.legs...))
+		if len(flights) != c.flights {
+			t.Errorf("%s: expected %d flights, got %v", c.name, c.flights, flights)
+		}
+	}
+
+	points := syntheticTrack([3]float64{120, 0.5, 0}, [3]float64{600, 10, -1}, [3]float64{120, 0, 0})
+	flights := detectFlights(points)
+	if len(flights) != 1 {
+		t.Fatalf("Expected one flight, got %v", flights)
+	}
+	takeoff := points[flights[0].Takeoff].Time.Sub(points[0].Time)
+	landing := points[flights[0].Landing].Time.Sub(points[0].Time)
+	if takeoff < 110*time.Second || takeoff > 120*time.Second {
+		t.Errorf("Expected takeoff at 120s, got %v", takeoff)
+	}
+	if landing < 710*time.Second || landing > 720*time.Second {
+		t.Errorf("Expected landing at 720s, got %v", landing)
+	}
+}
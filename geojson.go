@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/geo/s1"
+	"github.com/golang/geo/s2"
+	"github.com/marni/goigc"
+)
+
+// content type of the GeoJSON exports, see RFC 7946
+const geojsonContentType = "application/geo+json"
+
+// geoFeature is a track as a GeoJSON Feature: its path, and its fields as
+// properties
+type geoFeature struct {
+	Type       string        `json:"type"`
+	Geometry   geoLineString `json:"geometry"`
+	Properties geoProperties `json:"properties"`
+}
+
+type geoLineString struct {
+	Type        string      `json:"type"`
+	Coordinates [][]float64 `json:"coordinates"` // lng, lat, alt
+}
+
+// the fields of a track, with its ID
+type geoProperties struct {
+	ID int `json:"id"`
+	igcFields
+}
+
+// geoFeatureCollection holds several tracks
+type geoFeatureCollection struct {
+	Type     string       `json:"type"`
+	Features []geoFeature `json:"features"`
+}
+
+// the response type for GET /paragliding/api/track/<id>/polyline
+type trackPolyline struct {
+	Polyline string `json:"polyline"`
+	Points   int    `json:"points"`
+}
+
+// Builds the GeoJSON Feature of a track, with its path simplified to
+// within tolerance metres
+func newFeature(track igc.Track, fields igcFields, tolerance float64) geoFeature {
+	points := simplify(track.Points, tolerance)
+	alt := absoluteAltitudes(points)
+	coordinates := make([][]float64, len(points))
+	for i, p := range points {
+		coordinates[i] = []float64{
+			round(p.Lng.Degrees(), 6),
+			round(p.Lat.Degrees(), 6),
+			alt[i],
+		}
+	}
+	return geoFeature{
+		Type:       "Feature",
+		Geometry:   geoLineString{Type: "LineString", Coordinates: coordinates},
+		Properties: geoProperties{ID: fields.TrackID, igcFields: fields},
+	}
+}
+
+// Simplifies the path with the Douglas-Peucker algorithm on the sphere:
+// the fixes kept are such that none left out is further than tolerance
+// metres from the path. A tolerance of 0 keeps every fix.
+func simplify(points []igc.Point, tolerance float64) []igc.Point {
+	if tolerance <= 0 || len(points) < 3 {
+		return points
+	}
+	limit := s1.Angle(tolerance / 1000 / igc.EarthRadius)
+	vectors := make([]s2.Point, len(points))
+	for i, p := range points {
+		vectors[i] = s2.PointFromLatLng(p.LatLng)
+	}
+
+	keep := make([]bool, len(points))
+	keep[0], keep[len(points)-1] = true, true
+	// stretches still to simplify, as pairs of first and last fix
+	stack := [][2]int{{0, len(points) - 1}}
+	for len(stack) > 0 {
+		first, last := stack[len(stack)-1][0], stack[len(stack)-1][1]
+		stack = stack[:len(stack)-1]
+
+		furthest, distance := -1, limit
+		for i := first + 1; i < last; i++ {
+			if d := s2.DistanceFromSegment(vectors[i], vectors[first], vectors[last]); d > distance {
+				furthest, distance = i, d
+			}
+		}
+		if furthest >= 0 {
+			keep[furthest] = true
+			stack = append(stack, [2]int{first, furthest}, [2]int{furthest, last})
+		}
+	}
+
+	simplified := make([]igc.Point, 0)
+	for i, p := range points {
+		if keep[i] {
+			simplified = append(simplified, p)
+		}
+	}
+	return simplified
+}
+
+// Encodes the fixes in Google's encoded polyline format: latitude and
+// longitude at 5 decimals, as differences from the previous fix
+func encodePolyline(points []igc.Point) string {
+	var b strings.Builder
+	lat, lng := 0, 0
+	for _, p := range points {
+		nextLat := int(math.Round(p.Lat.Degrees() * 1e5))
+		nextLng := int(math.Round(p.Lng.Degrees() * 1e5))
+		encodeValue(&b, nextLat-lat)
+		encodeValue(&b, nextLng-lng)
+		lat, lng = nextLat, nextLng
+	}
+	return b.String()
+}
+
+// Writes one signed value of an encoded polyline, in 5-bit chunks
+func encodeValue(b *strings.Builder, v int) {
+	u := v << 1
+	if v < 0 {
+		u = ^u
+	}
+	for u >= 0x20 {
+		b.WriteByte(byte(0x20|u&0x1f) + 63)
+		u >>= 5
+	}
+	b.WriteByte(byte(u) + 63)
+}
+
+// Rounds to the given number of decimals
+func round(f float64, decimals int) float64 {
+	scale := math.Pow(10, float64(decimals))
+	return math.Round(f*scale) / scale
+}
+
+// Reads ?tolerance=, in metres. Writes the error response and returns
+// false when it is not a number of metres.
+func toleranceFromQuery(w http.ResponseWriter, r *http.Request) (float64, bool) {
+	v := r.URL.Query().Get("tolerance")
+	if v == "" {
+		return 0, true
+	}
+	tolerance, err := strconv.ParseFloat(v, 64)
+	if err != nil || tolerance < 0 || math.IsInf(tolerance, 0) {
+		writeError(w, http.StatusBadRequest, "invalid_tolerance", "tolerance must be a number of metres")
+		return 0, false
+	}
+	return tolerance, true
+}
+
+// GET api/track/<id>/geojson exports the track as a GeoJSON Feature.
+// ?tolerance= simplifies the path to within that many metres.
+func (s *server) geojsonHandler(w http.ResponseWriter, r *http.Request, fields igcFields) {
+	tolerance, ok := toleranceFromQuery(w, r)
+	if !ok {
+		return
+	}
+	track, ok := s.loadTrack(w, fields)
+	if !ok {
+		return
+	}
+	feature := newFeature(track, fields, tolerance)
+
+	http.Header.Add(w.Header(), "content-type", geojsonContentType)
+	if err := json.NewEncoder(w).Encode(&feature); err != nil {
+		status := 500
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+}
+
+// GET api/track/<id>/polyline returns the path of the track as an encoded
+// polyline. ?tolerance= simplifies it to within that many metres.
+func (s *server) polylineHandler(w http.ResponseWriter, r *http.Request, fields igcFields) {
+	tolerance, ok := toleranceFromQuery(w, r)
+	if !ok {
+		return
+	}
+	track, ok := s.loadTrack(w, fields)
+	if !ok {
+		return
+	}
+	points := simplify(track.Points, tolerance)
+	result := trackPolyline{Polyline: encodePolyline(points), Points: len(points)}
+
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(&result); err != nil {
+		status := 500
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+}
+
+// GET api/geojson exports the tracks as a GeoJSON FeatureCollection:
+// every track, or those of ?pilot=. ?tolerance= simplifies the paths.
+func (s *server) collectionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		status := 405
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	tolerance, ok := toleranceFromQuery(w, r)
+	if !ok {
+		return
+	}
+	tracks, err := s.store.List()
+	if err != nil {
+		status := 500
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	pilot := r.URL.Query().Get("pilot")
+	collection := geoFeatureCollection{Type: "FeatureCollection", Features: make([]geoFeature, 0)}
+	for _, fields := range tracks {
+		if pilot != "" && !strings.EqualFold(fields.Pilot, pilot) {
+			continue
+		}
+		track, err := s.readTrack(fields.TrackID)
+		if err != nil {
+			// a track without its file has no path to draw
+			log.Printf("could not load igc file of track %d: %v", fields.TrackID, err)
+			continue
+		}
+		collection.Features = append(collection.Features, newFeature(track, fields, tolerance))
+	}
+
+	http.Header.Add(w.Header(), "content-type", geojsonContentType)
+	if err := json.NewEncoder(w).Encode(&collection); err != nil {
+		status := 500
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/marni/goigc"
+)
+
+func TestSimplify(t *testing.T) {
+	// straight north, with a 100 m kink in the middle
+	points := syntheticTrack([3]float64{60, 10, 0})
+	kink := len(points) / 2
+	points[kink] = igc.NewPointFromLatLng(points[kink].Lat.Degrees(), 8.0+100/(111195*0.6947))
+
+	cases := []struct {
+		tolerance float64
+		expected  int
+	}{
+		{0, len(points)},
+		{50, 5},
+		{150, 2},
+	}
+	for _, c := range cases {
+		simplified := simplify(points, c.tolerance)
+		if len(simplified) != c.expected {
+			t.Errorf("Tolerance %v: expected %d fixes, got %d", c.tolerance, c.expected, len(simplified))
+			continue
+		}
+		if !simplified[0].Time.Equal(points[0].Time) || !simplified[len(simplified)-1].Time.Equal(points[len(points)-1].Time) {
+			t.Errorf("Tolerance %v: expected the ends to be kept", c.tolerance)
+		}
+	}
+}
+
+func TestEncodePolyline(t *testing.T) {
+	// the example of the format's documentation
+	points := []igc.Point{
+		igc.NewPointFromLatLng(38.5, -120.2),
+		igc.NewPointFromLatLng(40.7, -120.95),
+		igc.NewPointFromLatLng(43.252, -126.453),
+	}
+	if encoded := encodePolyline(points); encoded != "_p~iF~ps|U_ulLnnqC_mqNvxq`@" {
+		t.Errorf("Unexpected polyline %s", encoded)
+	}
+}
+
+// Gets url and decodes its json body into v
+func getJSON(t *testing.T, url string, contentType string, v interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Error creating the GET request, %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %s, got %d", url, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("content-type"); ct != contentType {
+		t.Errorf("Expected content type %s, got %s", contentType, ct)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("Error decoding %s, %s", url, err)
+	}
+}
+
+func TestTrackGeoJSON(t *testing.T) {
+	srv := newTestServer()
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	id := uploadFlight(t, ts.URL, "testdata/flight.igc")
+	trackURL := ts.URL + root + "/api/track/" + strconv.Itoa(id)
+
+	feature := geoFeature{}
+	getJSON(t, trackURL+"/geojson", geojsonContentType, &feature)
+	if feature.Type != "Feature" || feature.Geometry.Type != "LineString" {
+		t.Fatalf("Expected a LineString feature, got %s %s", feature.Type, feature.Geometry.Type)
+	}
+	if len(feature.Geometry.Coordinates) != 2206 {
+		t.Errorf("Expected every fix, got %d", len(feature.Geometry.Coordinates))
+	}
+	if c := feature.Geometry.Coordinates[0]; len(c) != 3 || c[0] != 8 || c[1] != 46.000017 || c[2] != 999 {
+		t.Errorf("Expected lng, lat and alt, got %v", c)
+	}
+	if p := feature.Properties; p.ID != id || p.Pilot != "Jane Doe" || p.Fixes != 2027 {
+		t.Errorf("Expected the track fields as properties, got %+v", p)
+	}
+
+	simplified := geoFeature{}
+	getJSON(t, trackURL+"/geojson?tolerance=50", geojsonContentType, &simplified)
+	n := len(simplified.Geometry.Coordinates)
+	if n < 10 || n > 1000 {
+		t.Errorf("Expected the path simplified, got %d fixes", n)
+	}
+
+	polyline := trackPolyline{}
+	getJSON(t, trackURL+"/polyline?tolerance=50", "application/json", &polyline)
+	if polyline.Points != n || polyline.Polyline == "" {
+		t.Errorf("Expected a polyline of %d fixes, got %d", n, polyline.Points)
+	}
+
+	resp, err := http.Get(trackURL + "/geojson?tolerance=far")
+	if err != nil {
+		t.Fatalf("Error creating the GET request, %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid tolerance, got %d", resp.StatusCode)
+	}
+}
+
+func TestGeoJSONCollection(t *testing.T) {
+	srv := newTestServer()
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	other := filepath.Join(t.TempDir(), "other.igc")
+	content := "AXXX001\r\nHFDTE170818\r\nHFPLTPILOTINCHARGE:John Roe\r\n" +
+		"B1000004600000N00800000EA0100001000\r\nB1000024600100N00800000EA0100001000\r\n"
+	if err := ioutil.WriteFile(other, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id := uploadFlight(t, ts.URL, "testdata/flight.igc")
+	uploadFlight(t, ts.URL, other)
+
+	collection := geoFeatureCollection{}
+	getJSON(t, ts.URL+root+"/api/geojson", geojsonContentType, &collection)
+	if collection.Type != "FeatureCollection" || len(collection.Features) != 2 {
+		t.Fatalf("Expected 2 features, got %s of %d", collection.Type, len(collection.Features))
+	}
+
+	collection = geoFeatureCollection{}
+	getJSON(t, ts.URL+root+"/api/geojson?pilot=jane+doe&tolerance=50", geojsonContentType, &collection)
+	if len(collection.Features) != 1 || collection.Features[0].Properties.ID != id {
+		t.Fatalf("Expected the track of the pilot, got %d features", len(collection.Features))
+	}
+	if n := len(collection.Features[0].Geometry.Coordinates); n >= 2206 {
+		t.Errorf("Expected the path simplified, got %d fixes", n)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+// thresholds of the glide analysis
+const (
+	// shorter straight stretches are transitions, not glides
+	minGlide = 30 * time.Second
+	// the best glide must be held at least this long
+	sustainedGlide = 2 * time.Minute
+	// and lose at least this much height (m), the ratio of a smaller loss
+	// is mostly the noise of the altimeter
+	minGlideLoss = 50.0
+)
+
+// glide is a straight part of a flight, between takeoff, thermals and
+// landing. The glide ratio is 0 when no height was lost.
+type glide struct {
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Duration     int       `json:"duration"`      // seconds
+	Distance     float64   `json:"distance"`      // km
+	AltitudeLost float64   `json:"altitude_lost"` // m
+	GlideRatio   float64   `json:"glide_ratio"`
+	AvgSpeed     float64   `json:"avg_speed"` // km/h
+
+	// indexes of the first and last fix in the track
+	first, last int
+}
+
+// Returns the glides of the flights: what is left of every flight
+// between its thermals, leaving out stretches shorter than minGlide
+func detectGlides(points []igc.Point, flights []flightSegment, thermals []thermal) []glide {
+	glides := make([]glide, 0)
+	alt := altitudes(points)
+
+	add := func(first, last int) {
+		if first < last && points[last].Time.Sub(points[first].Time) >= minGlide {
+			glides = append(glides, newGlide(points, alt, first, last))
+		}
+	}
+
+	t := 0
+	for _, f := range flights {
+		from := f.Takeoff
+		for ; t < len(thermals) && thermals[t].last <= f.Landing; t++ {
+			add(from, thermals[t].first)
+			from = thermals[t].last
+		}
+		add(from, f.Landing)
+	}
+	return glides
+}
+
+// Describes the glide from fix first to fix last
+func newGlide(points []igc.Point, alt []float64, first, last int) glide {
+	g := glide{
+		Start:        points[first].Time,
+		End:          points[last].Time,
+		Distance:     trackDistance(points[first : last+1]),
+		AltitudeLost: alt[first] - alt[last],
+		first:        first,
+		last:         last,
+	}
+	g.GlideRatio = glideRatio(g.Distance, g.AltitudeLost)
+
+	seconds := points[last].Time.Sub(points[first].Time).Seconds()
+	g.Duration = int(seconds)
+	if seconds > 0 {
+		g.AvgSpeed = g.Distance / (seconds / 3600)
+	}
+	return g
+}
+
+// Returns the overall glide ratio of the glides, and the best glide ratio
+// held for sustainedGlide within one of them, losing at least minGlideLoss
+func summarizeGlides(points []igc.Point, glides []glide) (float64, float64) {
+	alt := altitudes(points)
+	distance, lost, best := 0.0, 0.0, 0.0
+	for _, g := range glides {
+		distance += g.Distance
+		lost += g.AltitudeLost
+
+		j := g.first
+		for i := g.first; i <= g.last; i++ {
+			for j <= g.last && points[j].Time.Sub(points[i].Time) < sustainedGlide {
+				j++
+			}
+			if j > g.last {
+				break
+			}
+			if alt[i]-alt[j] < minGlideLoss {
+				continue
+			}
+			ratio := glideRatio(trackDistance(points[i:j+1]), alt[i]-alt[j])
+			best = math.Max(best, ratio)
+		}
+	}
+	return glideRatio(distance, lost), best
+}
+
+// Metres flown per metre of height lost, for a distance in km and a loss
+// in metres. 0 when no height was lost.
+func glideRatio(distance float64, lost float64) float64 {
+	if lost <= 0 {
+		return 0
+	}
+	return distance * 1000 / lost
+}
+
+// GET api/track/<id>/glides lists the glides of the track
+func (s *server) glidesHandler(w http.ResponseWriter, r *http.Request, fields igcFields) {
+	track, ok := s.loadTrack(w, fields)
+	if !ok {
+		return
+	}
+	flights := airborneSegments(track.Points)
+	thermals := detectThermals(track.Points, flights)
+	glides := detectGlides(track.Points, flights, thermals)
+
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(&glides); err != nil {
+		status := 500
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+}
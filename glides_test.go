@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestDetectGlides(t *testing.T) {
+	track := parseTestFlight(t, "testdata/flight.igc")
+	flights := airborneSegments(track.Points)
+	thermals := detectThermals(track.Points, flights)
+	glides := detectGlides(track.Points, flights, thermals)
+
+	// a minute from launch to the first thermal at 9m/s sinking 1m/s, then
+	// two 10km glides between the thermals and the final glide at 11m/s
+	// sinking 1.1m/s
+	expected := []struct {
+		distance float64
+		speed    float64
+	}{
+		{0.54, 32.4},
+		{10, 39.6},
+		{10, 39.6},
+		{10.6, 39.6},
+	}
+	if len(glides) != len(expected) {
+		t.Fatalf("Expected %d glides, got %d", len(expected), len(glides))
+	}
+	for i, want := range expected {
+		g := glides[i]
+		if g.Distance < want.distance*0.9 || g.Distance > want.distance*1.1 {
+			t.Errorf("Glide %d: expected about %.1fkm, got %.2f", i, want.distance, g.Distance)
+		}
+		if g.GlideRatio < 8.5 || g.GlideRatio > 11 {
+			t.Errorf("Glide %d: expected a glide ratio about 10, got %.1f", i, g.GlideRatio)
+		}
+		if g.AvgSpeed < want.speed*0.9 || g.AvgSpeed > want.speed*1.1 {
+			t.Errorf("Glide %d: expected about %.0fkm/h, got %.1f", i, want.speed, g.AvgSpeed)
+		}
+		if g.AltitudeLost <= 0 {
+			t.Errorf("Glide %d: expected to lose height, got %.0fm", i, g.AltitudeLost)
+		}
+	}
+
+	ratio, best := summarizeGlides(track.Points, glides)
+	if ratio < 9.5 || ratio > 10.5 {
+		t.Errorf("Expected an overall glide ratio about 10, got %.2f", ratio)
+	}
+	if best < ratio || best > 11 {
+		t.Errorf("Expected a best glide between %.2f and 11, got %.2f", ratio, best)
+	}
+}
+
+func TestBestGlideNearLevel(t *testing.T) {
+	// 5 minutes straight in weak lift, losing a metre and a half, then 5
+	// minutes at 10 m/s sinking 1 m/s
+	points := syntheticTrack([3]float64{300, 10, -0.005}, [3]float64{300, 10, -1})
+	glides := []glide{newGlide(points, altitudes(points), 0, len(points)-1)}
+
+	// the windows that lose minGlideLoss over 2 minutes glide 24 at most
+	_, best := summarizeGlides(points, glides)
+	if best < 9.5 || best > 24 {
+		t.Errorf("Expected a best glide between 10 and 24, got %.1f", best)
+	}
+}
+
+func TestGlideRatio(t *testing.T) {
+	if r := glideRatio(1, 100); r != 10 {
+		t.Errorf("Expected 10 for 1km losing 100m, got %f", r)
+	}
+	if r := glideRatio(1, -20); r != 0 {
+		t.Errorf("Expected 0 when climbing, got %f", r)
+	}
+}
+
+func TestTrackGlides(t *testing.T) {
+	srv := newTestServer()
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	id := uploadFlight(t, ts.URL, "testdata/flight.igc")
+	resp, err := http.Get(ts.URL + root + "/api/track/" + strconv.Itoa(id) + "/glides")
+	if err != nil {
+		t.Fatalf("Error creating the GET request, %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the glides, got %d", resp.StatusCode)
+	}
+	glides := []map[string]interface{}{}
+	if err = json.NewDecoder(resp.Body).Decode(&glides); err != nil {
+		t.Fatalf("Error decoding glides, %s", err)
+	}
+	if len(glides) != 4 {
+		t.Fatalf("Expected 4 glides, got %d", len(glides))
+	}
+	for _, field := range []string{"start", "end", "duration", "distance", "altitude_lost", "glide_ratio", "avg_speed"} {
+		if _, ok := glides[1][field]; !ok {
+			t.Errorf("Expected %s in the glide", field)
+		}
+	}
+
+	fields, err := srv.store.Get(id)
+	if err != nil {
+		t.Fatalf("Error loading track, %s", err)
+	}
+	if fields.GlideRatio < 9.5 || fields.GlideRatio > 10.5 {
+		t.Errorf("Expected an overall glide ratio about 10, got %.2f", fields.GlideRatio)
+	}
+	if fields.BestGlide < fields.GlideRatio {
+		t.Errorf("Expected the best glide above %.2f, got %.2f", fields.GlideRatio, fields.BestGlide)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// largest archive accepted by the import, compressed and uncompressed
+const maxImportSize = 200 << 20
+
+// outcome of one file of an import
+const (
+	importImported  = "imported"
+	importValid     = "valid" // dry run, the file would be imported
+	importDuplicate = "duplicate"
+	importError     = "error"
+)
+
+// errImportTooLarge is returned when an archive holds more than maxImportSize
+var errImportTooLarge = fmt.Errorf("archive exceeds %d bytes", maxImportSize)
+
+// errUnknownArchive is returned for bodies that are neither zip nor tar.gz
+var errUnknownArchive = errors.New("expected a zip or tar.gz archive")
+
+// an IGC file read from an archive
+type archiveFile struct {
+	name    string
+	content []byte
+}
+
+// importResult reports what happened to one file of the archive
+type importResult struct {
+	File        string `json:"file"`
+	Status      string `json:"status"`
+	TrackID     *int   `json:"id,omitempty"`
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+	Error       string `json:"error,omitempty"`
+
+	Warnings []parseWarning `json:"warnings,omitempty"`
+}
+
+// the response type for POST /paragliding/admin/api/import
+type importReport struct {
+	DryRun     bool           `json:"dry_run"`
+	Imported   int            `json:"imported"`
+	Duplicates int            `json:"duplicates"`
+	Errors     int            `json:"errors"`
+	Files      []importResult `json:"files"`
+}
+
+// POST admin/api/import takes a zip or tar.gz of IGC files, as the body or
+// as a multipart "file", and imports every .igc file in it.
+// With ?dry_run=true the files are only parsed.
+func (s *server) importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		status := 405
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	archive, err := readArchive(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_archive", err.Error())
+		return
+	}
+
+	files, err := unpackArchive(archive)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_archive", err.Error())
+		return
+	}
+
+	report := s.importFiles(files, dryRun)
+
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	if err = json.NewEncoder(w).Encode(&report); err != nil {
+		status := 500
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+}
+
+// Reads the archive from the request body or from a multipart upload
+func readArchive(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("content-type"))
+	if mediaType != "multipart/form-data" {
+		return ioutil.ReadAll(r.Body)
+	}
+
+	file, _, err := r.FormFile(uploadField)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+// Returns the .igc files of a zip or tar.gz archive, told apart by their
+// magic bytes
+func unpackArchive(archive []byte) ([]archiveFile, error) {
+	switch {
+	case bytes.HasPrefix(archive, []byte("PK\x03\x04")):
+		return unpackZip(archive)
+	case bytes.HasPrefix(archive, []byte{0x1f, 0x8b}):
+		return unpackTarGz(archive)
+	default:
+		return nil, errUnknownArchive
+	}
+}
+
+// Only .igc files count, skipping folders and the metadata some archivers add
+func isIGCFile(name string) bool {
+	base := path.Base(name)
+	return strings.EqualFold(path.Ext(name), ".igc") &&
+		!strings.HasPrefix(base, ".") &&
+		!strings.HasPrefix(name, "__MACOSX/")
+}
+
+func unpackZip(archive []byte) ([]archiveFile, error) {
+	z, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]archiveFile, 0)
+	total := int64(0)
+	for _, f := range z.File {
+		if f.FileInfo().IsDir() || !isIGCFile(f.Name) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name, err)
+		}
+		content, err := readEntry(rc, &total)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name, err)
+		}
+		files = append(files, archiveFile{name: f.Name, content: content})
+	}
+	return files, nil
+}
+
+func unpackTarGz(archive []byte) ([]archiveFile, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	files := make([]archiveFile, 0)
+	total := int64(0)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg || !isIGCFile(header.Name) {
+			continue
+		}
+		content, err := readEntry(tr, &total)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", header.Name, err)
+		}
+		files = append(files, archiveFile{name: header.Name, content: content})
+	}
+}
+
+// Reads one archive entry, keeping the uncompressed total under
+// maxImportSize so a small archive can't expand without bounds
+func readEntry(r io.Reader, total *int64) ([]byte, error) {
+	content, err := ioutil.ReadAll(io.LimitReader(r, maxImportSize-*total+1))
+	if err != nil {
+		return nil, err
+	}
+	*total += int64(len(content))
+	if *total > maxImportSize {
+		return nil, errImportTooLarge
+	}
+	return content, nil
+}
+
+// Parses, and unless dryRun stores, the files on a pool of workers.
+// A file with the same content or the same flight as an earlier file of
+// the archive is reported as a duplicate of it, a flight already stored as
+// a duplicate of that track.
+func (s *server) importFiles(files []archiveFile, dryRun bool) importReport {
+	report := importReport{DryRun: dryRun, Files: make([]importResult, len(files))}
+
+	// the content hash of every file, and the flight fingerprint of those
+	// that parse
+	keys := make([][]string, len(files))
+	all := make([]int, len(files))
+	for i := range files {
+		all[i] = i
+	}
+	parallel(all, func(i int) {
+		keys[i] = []string{"hash:" + contentHash(files[i].content)}
+		if fields, err := scanIGC(submission{Content: files[i].content}); err == nil && fields.Fingerprint != "" {
+			keys[i] = append(keys[i], "fingerprint:"+fields.Fingerprint)
+		}
+	})
+
+	// index of the first file with the same content or flight, for every file
+	first := make([]int, len(files))
+	seen := make(map[string]int)
+	originals := make([]int, 0, len(files))
+	for i := range files {
+		first[i] = i
+		for _, key := range keys[i] {
+			if j, ok := seen[key]; ok {
+				first[i] = j
+				break
+			}
+		}
+		if first[i] != i {
+			continue
+		}
+		for _, key := range keys[i] {
+			seen[key] = i
+		}
+		originals = append(originals, i)
+	}
+
+	parallel(originals, func(i int) {
+		report.Files[i] = s.importFile(files[i], dryRun)
+	})
+
+	for i, f := range files {
+		if first[i] != i {
+			original := report.Files[first[i]]
+			report.Files[i] = importResult{
+				File:        f.name,
+				Status:      importDuplicate,
+				TrackID:     original.TrackID,
+				DuplicateOf: original.File,
+			}
+		}
+
+		switch report.Files[i].Status {
+		case importImported, importValid:
+			report.Imported++
+		case importDuplicate:
+			report.Duplicates++
+		default:
+			report.Errors++
+		}
+	}
+	return report
+}
+
+// Runs fn for every index on a pool of workers, one per CPU
+func parallel(indexes []int, fn func(int)) {
+	pending := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < runtime.NumCPU(); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range pending {
+				fn(i)
+			}
+		}()
+	}
+	for _, i := range indexes {
+		pending <- i
+	}
+	close(pending)
+	wg.Wait()
+}
+
+// Imports a single file of the archive
+func (s *server) importFile(f archiveFile, dryRun bool) importResult {
+	result := importResult{File: f.name}
+	sub := submission{Content: f.content, Name: path.Base(f.name)}
+
+	if dryRun {
+		fields, err := scanIGC(sub)
+		if err != nil {
+			result.Status = importError
+			result.Error = err.Error()
+			return result
+		}
+		err = s.checkDuplicate(fields)
+		if de, ok := err.(*duplicateError); ok {
+			result.Status = importDuplicate
+			result.TrackID = &de.TrackID
+			return result
+		}
+		if err != nil {
+			result.Status = importError
+			result.Error = err.Error()
+			return result
+		}
+		result.Status = importValid
+		result.Warnings = fields.Warnings
+		return result
+	}
+
+	fields, err := s.ingest(sub)
+	if de, ok := err.(*duplicateError); ok {
+		result.Status = importDuplicate
+		result.TrackID = &de.TrackID
+		return result
+	}
+	if err != nil {
+		if _, ok := err.(*parseError); !ok {
+			log.Printf("could not import %s: %v", f.name, err)
+		}
+		result.Status = importError
+		result.Error = err.Error()
+		return result
+	}
+	result.Status = importImported
+	result.TrackID = &fields.TrackID
+	result.Warnings = fields.Warnings
+	return result
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// contents of the archives used in the tests, in archive order
+func importTestFiles(t *testing.T) ([]string, [][]byte) {
+	content, err := ioutil.ReadFile("testdata/flight.igc")
+	if err != nil {
+		t.Fatalf("Error reading test flight, %s", err)
+	}
+	// the same flight, signed by another tool
+	resigned := bytes.Replace(content, []byte("G1A2B3C4D5E6F"), []byte("GFFEEDDCCBBAA"), 1)
+	names := []string{"season/a.igc", "season/b.IGC", "season/broken.igc", "season/notes.txt", "season/resigned.igc"}
+	contents := [][]byte{content, content, []byte("HFDTE\r\n"), []byte("not a flight"), resigned}
+	return names, contents
+}
+
+func zipArchive(t *testing.T) []byte {
+	names, contents := importTestFiles(t)
+	buf := &bytes.Buffer{}
+	z := zip.NewWriter(buf)
+	for i, name := range names {
+		f, _ := z.Create(name)
+		_, _ = f.Write(contents[i])
+	}
+	if err := z.Close(); err != nil {
+		t.Fatalf("Error writing zip, %s", err)
+	}
+	return buf.Bytes()
+}
+
+func tarGzArchive(t *testing.T) []byte {
+	names, contents := importTestFiles(t)
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for i, name := range names {
+		_ = tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents[i])), Typeflag: tar.TypeReg})
+		_, _ = tw.Write(contents[i])
+	}
+	_ = tw.Close()
+	if err := gz.Close(); err != nil {
+		t.Fatalf("Error writing tar.gz, %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestImport(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		archive []byte
+		query   string
+		status  string
+		stored  int
+	}{
+		{"zip", zipArchive(t), "", importImported, 1},
+		{"tar.gz", tarGzArchive(t), "", importImported, 1},
+		{"dry run", zipArchive(t), "?dry_run=true", importValid, 0},
+	} {
+		srv := newTestServer()
+		ts := httptest.NewServer(srv.routes())
+
+		resp, err := http.Post(ts.URL+root+"/admin/api/import"+c.query, "application/octet-stream", bytes.NewReader(c.archive))
+		if err != nil {
+			t.Fatalf("%s: error creating the POST request, %s", c.name, err)
+		}
+		report := importReport{}
+		if err = json.NewDecoder(resp.Body).Decode(&report); err != nil {
+			t.Fatalf("%s: error decoding report, %s", c.name, err)
+		}
+		resp.Body.Close()
+		ts.Close()
+
+		if len(report.Files) != 4 {
+			t.Fatalf("%s: expected 4 igc files, got %v", c.name, report.Files)
+		}
+		if report.Files[0].Status != c.status {
+			t.Errorf("%s: expected first file %s, got %v", c.name, c.status, report.Files[0])
+		}
+		if report.Files[1].Status != importDuplicate || report.Files[1].DuplicateOf != "season/a.igc" {
+			t.Errorf("%s: expected second file to duplicate the first, got %v", c.name, report.Files[1])
+		}
+		if report.Files[2].Status != importError || report.Files[2].Error == "" {
+			t.Errorf("%s: expected the parser error, got %v", c.name, report.Files[2])
+		}
+		if report.Files[3].Status != importDuplicate || report.Files[3].DuplicateOf != "season/a.igc" {
+			t.Errorf("%s: expected the resigned file to duplicate the first, got %v", c.name, report.Files[3])
+		}
+		if report.Imported != 1 || report.Duplicates != 2 || report.Errors != 1 {
+			t.Errorf("%s: unexpected totals %+v", c.name, report)
+		}
+		if n, _ := srv.store.Count(); n != c.stored {
+			t.Errorf("%s: expected %d stored tracks, got %d", c.name, c.stored, n)
+		}
+	}
+}
+
+func TestImportNotAnArchive(t *testing.T) {
+	srv := newTestServer()
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+root+"/admin/api/import", "application/zip", bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatalf("Error creating the POST request, %s", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", resp.StatusCode)
+	}
+}
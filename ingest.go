@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/marni/goigc"
+)
+
+// largest request body accepted when submitting a track
+const maxUploadSize = 10 << 20
+
+// form field holding an uploaded IGC file
+const uploadField = "file"
+
+// a track as submitted by the client
+type submission struct {
+	Content []byte // the IGC file
+	URL     string // where the file was fetched from, empty for uploads
+	Name    string // file name, if known
+}
+
+// The parser skips the lines it can't read rather than rejecting the file,
+// many recorders write records it doesn't know
+var parseOptions = igc.ParseOptions{Lenient: true}
+
+// parseWarning is a line of a submitted file the parser skipped
+type parseWarning struct {
+	Line   int    `json:"line"`
+	Record string `json:"record"` // record type, like "B" or "H"
+	Reason string `json:"reason"`
+}
+
+func parseWarnings(warnings []igc.Warning) []parseWarning {
+	if len(warnings) == 0 {
+		return nil
+	}
+	result := make([]parseWarning, len(warnings))
+	for i, w := range warnings {
+		result[i] = parseWarning{Line: w.Line, Record: w.Record, Reason: w.Reason}
+	}
+	return result
+}
+
+// errNoFixes is returned when a file parses but holds no B records
+var errNoFixes = errors.New("igc file has no fixes")
+
+// parseError wraps the reason an IGC file was rejected by the parser
+type parseError struct {
+	err error
+}
+
+func (e *parseError) Error() string {
+	return e.err.Error()
+}
+
+// duplicateError is returned by ingest when the flight is already stored
+type duplicateError struct {
+	TrackID int
+}
+
+func (e *duplicateError) Error() string {
+	return fmt.Sprintf("duplicate of track %d", e.TrackID)
+}
+
+// Reads a track submission, without fetching submitted URLs. It accepts
+//
+//	application/json           {"url": "..."}
+//	x-www-form-urlencoded      url=...
+//	multipart/form-data        a file in the "file" field, or a "url" field
+//	text/plain                 the IGC file itself
+func readSubmission(w http.ResponseWriter, r *http.Request) (submission, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("content-type"))
+	if err != nil {
+		// no or broken content type, fall back to the JSON request
+		mediaType = "application/json"
+	}
+
+	switch mediaType {
+	case "multipart/form-data":
+		if err = r.ParseMultipartForm(maxUploadSize); err != nil {
+			return submission{}, err
+		}
+		file, header, err := r.FormFile(uploadField)
+		if err == http.ErrMissingFile {
+			return submission{URL: r.FormValue("url")}, nil
+		}
+		if err != nil {
+			return submission{}, err
+		}
+		defer file.Close()
+		content, err := ioutil.ReadAll(file)
+		return submission{Content: content, Name: path.Base(header.Filename)}, err
+	case "application/x-www-form-urlencoded":
+		return submission{URL: r.FormValue("url")}, nil
+	case "text/plain":
+		content, err := ioutil.ReadAll(r.Body)
+		return submission{Content: content}, err
+	default:
+		req := trackURLRequest{}
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return submission{}, err
+		}
+		return submission{URL: req.URL}, nil
+	}
+}
+
+// Fetches the file of a URL submission, parses it and stores it as a new
+// track. Rejected files are reported as a *parseError, failed downloads as
+// a *fetchError and flights already stored as a *duplicateError.
+func (s *server) ingest(sub submission) (igcFields, error) {
+	var err error
+	if sub.Content == nil {
+		if sub, err = s.fetcher.Fetch(sub.URL); err != nil {
+			return igcFields{}, err
+		}
+	}
+
+	fields, err := parseIGC(sub)
+	if err != nil {
+		return fields, &parseError{err}
+	}
+
+	if err = s.checkDuplicate(fields); err != nil {
+		return fields, err
+	}
+
+	// Get unique ID
+	fields.TrackID, err = s.store.NextID()
+	if err != nil {
+		return fields, err
+	}
+
+	// The file goes first, so a stored track always has its file
+	if err = s.store.PutIGC(fields.TrackID, sub.Name, sub.Content); err != nil {
+		return fields, fmt.Errorf("could not store igc file of track %d: %v", fields.TrackID, err)
+	}
+	if err = s.store.Insert(fields); err != nil {
+		// the track ID is never used, nor is its file
+		if err := s.store.DeleteIGC(fields.TrackID); err != nil {
+			log.Printf("could not remove igc file of track %d: %v", fields.TrackID, err)
+		}
+		if err == errDuplicateFlight {
+			// stored by a concurrent submission since the check
+			if dupErr := s.checkDuplicate(fields); dupErr != nil {
+				return fields, dupErr
+			}
+		}
+		return fields, fmt.Errorf("could not store track %d: %v", fields.TrackID, err)
+	}
+	return fields, nil
+}
+
+// Returns a *duplicateError if a track with the same content hash or the
+// same flight fingerprint is stored
+func (s *server) checkDuplicate(fields igcFields) error {
+	existing, err := s.store.FindDuplicate(fields.Hash, fields.Fingerprint)
+	if err == errTrackNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return &duplicateError{existing.TrackID}
+}
+
+// SHA-256 of the file, ignoring line endings, trailing spaces and blank
+// lines, so the same file saved by different tools hashes the same
+func contentHash(content []byte) string {
+	h := sha256.New()
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			continue
+		}
+		_, _ = io.WriteString(h, line)
+		_, _ = io.WriteString(h, "\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Identifies a flight independently of the file it comes in: the recorder
+// (manufacturer and serial), the flight date and the first and last fix.
+// It is empty when the recorder or the date is unknown, as the flights of
+// anonymous or undated recorders can't be told apart.
+func fingerprint(header igc.Header, first, last igc.Point) string {
+	if header.Manufacturer == "" || header.UniqueID == "" || header.Date.IsZero() {
+		return ""
+	}
+	return strings.Join([]string{
+		header.Manufacturer,
+		header.UniqueID,
+		header.Date.Format(igc.DateFormat),
+		first.Time.Format(igc.TimeFormat),
+		last.Time.Format(igc.TimeFormat),
+	}, ":")
+}
+
+// Parses the submitted file and builds the track record. The track ID is
+// left for the caller to allocate.
+//
+// Only the fingerprint is worked out as the fixes are read. The file
+// itself is already in memory, as it is stored with the track, and the
+// fixes are all kept: the distance and the statistics are of the flight
+// between takeoff and landing, which are found by looking at the fixes
+// around every fix, like the thermals and glides, and the optimizers
+// compare fixes across the whole flight. Their I record extensions, which
+// none of the analyses use, are dropped as they are read.
+func parseIGC(sub submission) (igcFields, error) {
+
+	fields := igcFields{}
+	points := make([]igc.Point, 0)
+	var first, last igc.Point
+	track, warnings, err := parseOptions.ParseReaderFunc(bytes.NewReader(sub.Content), func(p igc.Point) error {
+		p.IData = nil
+		if len(points) == 0 {
+			first = p
+		}
+		last = p
+		points = append(points, p)
+		return nil
+	})
+	if err != nil {
+		return fields, err
+	}
+	track.Points = points
+	if len(track.Points) == 0 {
+		return fields, errNoFixes
+	}
+
+	// Calculate the distance flown, leaving out time on the ground
+	flights := airborneSegments(track.Points)
+	totalDistance := 0.0
+	for _, f := range flights {
+		totalDistance += trackDistance(track.Points[f.Takeoff : f.Landing+1])
+	}
+
+	fields = igcFields{
+		ID:           bson.NewObjectId(),
+		HDate:        track.Date,
+		Timezone:     track.TimezoneOffset.Hours(),
+		Pilot:        track.Pilot,
+		Glider:       track.GliderType,
+		GliderID:     track.GliderID,
+		TrackLen:     totalDistance,
+		OptDistance:  optimizedDistance(track, flights),
+		FAITriangle:  triangleDistance(track, flights, true),
+		FlatTriangle: triangleDistance(track, flights, false),
+		TrackURL:     sub.URL,
+		Timestamp:    time.Now(),
+		Hash:         contentHash(sub.Content),
+		Fingerprint:  fingerprint(track.Header, first, last),
+		Warnings:     parseWarnings(warnings),
+		flightStats:  computeStats(track.Points, flights)}
+
+	thermals := detectThermals(track.Points, flights)
+	fields.CirclingPercent, fields.AvgClimb = summarizeThermals(thermals, fields.Duration)
+	glides := detectGlides(track.Points, flights, thermals)
+	fields.GlideRatio, fields.BestGlide = summarizeGlides(track.Points, glides)
+
+	return fields, nil
+}
+
+// Reads the submitted file fix by fix without keeping the fixes, for the
+// checks that don't need the whole track: the file is valid and not a
+// duplicate. Only the header fields and the duplicate keys are set.
+func scanIGC(sub submission) (igcFields, error) {
+	var first, last igc.Point
+	fixes := 0
+	track, warnings, err := parseOptions.ParseReaderFunc(bytes.NewReader(sub.Content), func(p igc.Point) error {
+		if fixes == 0 {
+			first = p
+		}
+		last = p
+		fixes++
+		return nil
+	})
+	if err != nil {
+		return igcFields{}, err
+	}
+	if fixes == 0 {
+		return igcFields{}, errNoFixes
+	}
+
+	return igcFields{
+		HDate:       track.Date,
+		Timezone:    track.TimezoneOffset.Hours(),
+		Pilot:       track.Pilot,
+		Glider:      track.GliderType,
+		GliderID:    track.GliderID,
+		TrackURL:    sub.URL,
+		Hash:        contentHash(sub.Content),
+		Fingerprint: fingerprint(track.Header, first, last),
+		Warnings:    parseWarnings(warnings),
+	}, nil
+}
+
+// Parses the stored IGC file of a track, for the analyses that need the
+// fixes. Writes the error response and returns false when it can't.
+func (s *server) loadTrack(w http.ResponseWriter, fields igcFields) (igc.Track, bool) {
+	track, err := s.readTrack(fields.TrackID)
+	if err == errIGCNotFound {
+		status := 404
+		http.Error(w, http.StatusText(status), status)
+		return igc.Track{}, false
+	}
+	if err != nil {
+		log.Printf("could not load igc file of track %d: %v", fields.TrackID, err)
+		status := 500
+		http.Error(w, http.StatusText(status), status)
+		return igc.Track{}, false
+	}
+	return track, true
+}
+
+// Parses the stored IGC file of a track
+func (s *server) readTrack(id int) (igc.Track, error) {
+	file, _, err := s.store.OpenIGC(id)
+	if err != nil {
+		return igc.Track{}, err
+	}
+	defer file.Close()
+
+	track, _, err := parseOptions.ParseReader(file)
+	return track, err
+}
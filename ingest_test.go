@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+func TestDuplicateDetection(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/flight.igc")
+	if err != nil {
+		t.Fatalf("Error reading test flight, %s", err)
+	}
+
+	if contentHash(content) != contentHash(bytes.Replace(content, []byte("\r\n"), []byte("  \n\n"), -1)) {
+		t.Error("Expected the hash to ignore line endings, trailing spaces and blank lines")
+	}
+
+	// the same flight, signed by another tool
+	resigned := bytes.Replace(content, []byte("G1A2B3C4D5E6F"), []byte("GFFEEDDCCBBAA"), 1)
+	if contentHash(content) == contentHash(resigned) {
+		t.Fatal("Expected the resigned file to hash differently")
+	}
+
+	srv := newTestServer()
+	original, err := srv.ingest(submission{Content: content})
+	if err != nil {
+		t.Fatalf("Error ingesting the test flight, %s", err)
+	}
+
+	_, err = srv.ingest(submission{Content: resigned})
+	de, ok := err.(*duplicateError)
+	if !ok || de.TrackID != original.TrackID {
+		t.Errorf("Expected a duplicate of track %d by fingerprint, got %v", original.TrackID, err)
+	}
+
+	// flights of a recorder without an A record, at the same times
+	for _, position := range []string{"4600000N00800000E", "4700000N00900000E"} {
+		anonymous := "HFDTE160818\r\nB100000" + position + "A0100001000\r\nB100002" + position + "A0100201020\r\n"
+		if _, err = srv.ingest(submission{Content: []byte(anonymous)}); err != nil {
+			t.Errorf("Expected the flight at %s to be stored, got %v", position, err)
+		}
+	}
+}
+
+// a store that fails to insert tracks
+type failingInsertStore struct {
+	*memoryStore
+}
+
+func (failingInsertStore) Insert(igcFields) error {
+	return errors.New("insert failed")
+}
+
+func TestIngestInsertFailure(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/flight.igc")
+	if err != nil {
+		t.Fatalf("Error reading test flight, %s", err)
+	}
+	srv := newTestServer()
+	srv.store = failingInsertStore{newMemoryStore()}
+
+	fields, err := srv.ingest(submission{Content: content})
+	if err == nil {
+		t.Fatal("Expected the insert error")
+	}
+	if _, _, err = srv.store.OpenIGC(fields.TrackID); err != errIGCNotFound {
+		t.Errorf("Expected the file of track %d removed, got %v", fields.TrackID, err)
+	}
+}
+
+func TestConcurrentDuplicates(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/flight.igc")
+	if err != nil {
+		t.Fatalf("Error reading test flight, %s", err)
+	}
+	resigned := bytes.Replace(content, []byte("G1A2B3C4D5E6F"), []byte("GFFEEDDCCBBAA"), 1)
+
+	// the same flight submitted at once, in two files
+	srv := newTestServer()
+	results := make([]error, 8)
+	ids := make([]int, len(results))
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sub := submission{Content: content}
+			if i%2 == 1 {
+				sub.Content = resigned
+			}
+			fields, err := srv.ingest(sub)
+			results[i], ids[i] = err, fields.TrackID
+		}(i)
+	}
+	wg.Wait()
+
+	if n, _ := srv.store.Count(); n != 1 {
+		t.Fatalf("Expected the flight to be stored once, got %d tracks", n)
+	}
+	stored, _ := srv.store.Latest()
+	for i, err := range results {
+		if err == nil {
+			continue
+		}
+		if de, ok := err.(*duplicateError); !ok || de.TrackID != stored.TrackID {
+			t.Errorf("Expected a duplicate of track %d, got %v", stored.TrackID, err)
+		}
+		// the file stored before the track was rejected is gone
+		if ids[i] != stored.TrackID {
+			if _, _, err = srv.store.OpenIGC(ids[i]); err != errIGCNotFound {
+				t.Errorf("Expected no file for the rejected track %d, got %v", ids[i], err)
+			}
+		}
+	}
+}
+
+func TestScanIGC(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/flight.igc")
+	if err != nil {
+		t.Fatalf("Error reading test flight, %s", err)
+	}
+	sub := submission{Content: content}
+
+	parsed, err := parseIGC(sub)
+	if err != nil {
+		t.Fatalf("Error parsing test flight, %s", err)
+	}
+	scanned, err := scanIGC(sub)
+	if err != nil {
+		t.Fatalf("Error scanning test flight, %s", err)
+	}
+	if scanned.Hash != parsed.Hash || scanned.Fingerprint != parsed.Fingerprint || scanned.Pilot != parsed.Pilot {
+		t.Errorf("Expected the scan to find the same flight, got %+v", scanned)
+	}
+
+	if _, err = scanIGC(submission{Content: []byte("AXXX001\r\nHFDTE160818\r\n")}); err != errNoFixes {
+		t.Errorf("Expected errNoFixes, got %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// states of an ingestion job
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// URL index for the job ID in /paragliding/api/jobs/<id>
+const jobArg = 4
+
+// errQueueFull is returned by enqueue when every queue slot is taken
+var errQueueFull = errors.New("ingestion queue is full")
+
+// job is a track submission processed in the background.
+// The submission is kept with the job until it is processed, so queued
+// jobs survive a restart.
+type job struct {
+	ID       string         `bson:"_id" json:"id"`
+	Status   string         `bson:"status" json:"status"`
+	URL      string         `bson:"url,omitempty" json:"-"`
+	Name     string         `bson:"name,omitempty" json:"-"`
+	Content  []byte         `bson:"content,omitempty" json:"-"`
+	TrackID  *int           `bson:"track_id,omitempty" json:"track_id,omitempty"`
+	Error    string         `bson:"error,omitempty" json:"error,omitempty"`
+	Warnings []parseWarning `bson:"warnings,omitempty" json:"warnings,omitempty"`
+	Created  time.Time      `bson:"created" json:"created"`
+	Updated  time.Time      `bson:"updated" json:"updated"`
+}
+
+// the response type for an asynchronous POST /paragliding/api/track
+type resJob struct {
+	JobID string `json:"job_id"`
+}
+
+// Default worker pool, overridden by $INGEST_WORKERS and $INGEST_QUEUE
+func queueConfigFromEnv() (workers int, queueSize int, err error) {
+	workers, queueSize = 4, 100
+	if v := os.Getenv("INGEST_WORKERS"); v != "" {
+		if workers, err = strconv.Atoi(v); err != nil {
+			return workers, queueSize, fmt.Errorf("invalid $INGEST_WORKERS: %v", err)
+		}
+	}
+	if v := os.Getenv("INGEST_QUEUE"); v != "" {
+		if queueSize, err = strconv.Atoi(v); err != nil {
+			return workers, queueSize, fmt.Errorf("invalid $INGEST_QUEUE: %v", err)
+		}
+	}
+	return workers, queueSize, nil
+}
+
+// Starts n workers processing the jobs sent to s.jobs
+func (s *server) startWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for id := range s.jobs {
+				s.runJob(id)
+			}
+		}()
+	}
+}
+
+// Queues again the jobs that were queued or running when the service
+// stopped. Call it before serving requests, so new jobs are not picked
+// up twice.
+func (s *server) resumeJobs() error {
+	pending, err := s.store.PendingJobs()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		log.Printf("resuming %d pending jobs", len(pending))
+	}
+
+	go func() {
+		for _, j := range pending {
+			s.jobs <- j.ID
+		}
+	}()
+	return nil
+}
+
+// Stores the submission as a queued job and hands it to the workers
+func (s *server) enqueue(sub submission) (job, error) {
+	now := time.Now()
+	j := job{
+		ID:      bson.NewObjectId().Hex(),
+		Status:  jobQueued,
+		URL:     sub.URL,
+		Name:    sub.Name,
+		Content: sub.Content,
+		Created: now,
+		Updated: now,
+	}
+	if err := s.store.InsertJob(j); err != nil {
+		return j, err
+	}
+
+	select {
+	case s.jobs <- j.ID:
+		return j, nil
+	default:
+		s.finishJob(j, nil, nil, errQueueFull)
+		return j, errQueueFull
+	}
+}
+
+// Processes one job and records the outcome in the store
+func (s *server) runJob(id string) {
+	j, err := s.store.GetJob(id)
+	if err != nil {
+		log.Printf("could not load job %s: %v", id, err)
+		return
+	}
+	if j.Status == jobDone || j.Status == jobFailed {
+		return
+	}
+
+	j.Status = jobRunning
+	j.Updated = time.Now()
+	if err = s.store.UpdateJob(j); err != nil {
+		log.Printf("could not update job %s: %v", id, err)
+		return
+	}
+
+	fields, err := s.ingest(submission{Content: j.Content, URL: j.URL, Name: j.Name})
+	if de, ok := err.(*duplicateError); ok {
+		s.finishJob(j, &de.TrackID, fields.Warnings, err)
+		return
+	}
+	if err != nil {
+		s.finishJob(j, nil, nil, err)
+		return
+	}
+	s.finishJob(j, &fields.TrackID, fields.Warnings, nil)
+}
+
+// Marks the job done with the track ID and the lines the parser skipped,
+// or failed with the error. A duplicate fails with the ID of the track
+// already stored. The submission is dropped, it is no longer needed.
+func (s *server) finishJob(j job, trackID *int, warnings []parseWarning, jobErr error) {
+	j.Status = jobDone
+	j.TrackID = trackID
+	j.Warnings = warnings
+	if jobErr != nil {
+		j.Status = jobFailed
+		j.Error = jobErr.Error()
+	}
+	j.Content = nil
+	j.Updated = time.Now()
+
+	if err := s.store.UpdateJob(j); err != nil {
+		log.Printf("could not update job %s: %v", j.ID, err)
+	}
+}
+
+// Answers an asynchronous POST with 202 and the job ID
+func (s *server) enqueueHandler(w http.ResponseWriter, sub submission) {
+	j, err := s.enqueue(sub)
+	if err == errQueueFull {
+		status := 503
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if err != nil {
+		log.Printf("could not queue job: %v", err)
+		status := 500
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	http.Header.Add(w.Header(), "location", root+"/api/jobs/"+j.ID)
+	w.WriteHeader(http.StatusAccepted)
+	if err = json.NewEncoder(w).Encode(&resJob{j.ID}); err != nil {
+		log.Printf("could not send job %s: %v", j.ID, err)
+	}
+}
+
+// GET api/jobs/<id> reports the state of an ingestion job
+func (s *server) jobHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/") // array of url parts
+	if len(parts) != jobArg+1 || r.Method != http.MethodGet {
+		status := 404
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	j, err := s.store.GetJob(parts[jobArg])
+	if err == errJobNotFound {
+		status := 404
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if err != nil {
+		status := 500
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	if err = json.NewEncoder(w).Encode(&j); err != nil {
+		status := 500
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Polls the job until it leaves the queue
+func waitForJob(t *testing.T, baseURL string, id string) job {
+	for i := 0; i < 100; i++ {
+		resp, err := http.Get(baseURL + root + "/api/jobs/" + id)
+		if err != nil {
+			t.Fatalf("Error creating the GET request, %s", err)
+		}
+		j := job{}
+		err = json.NewDecoder(resp.Body).Decode(&j)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Error decoding job, %s", err)
+		}
+		if j.Status == jobDone || j.Status == jobFailed {
+			return j
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Job %s did not finish", id)
+	return job{}
+}
+
+func TestAsyncIngest(t *testing.T) {
+	srv := newTestServer()
+	srv.jobs = make(chan string, 10)
+	srv.startWorkers(2)
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	content, err := ioutil.ReadFile("testdata/flight.igc")
+	if err != nil {
+		t.Fatalf("Error reading test flight, %s", err)
+	}
+
+	// a site header the parser doesn't know and a broken fix
+	skipped := "AXXX001\r\nHFDTE170818\r\nHFSITSITE:Fiesch\r\n" +
+		"B1000004600000N00800000EA0100001000\r\nB100002460\r\nB1000044600200N00800000EA0100401040\r\n"
+
+	for _, c := range []struct {
+		body     []byte
+		status   string
+		warnings int
+	}{
+		{content, jobDone, 0},
+		{[]byte("not an igc file"), jobFailed, 0},
+		{[]byte(skipped), jobDone, 2},
+	} {
+		resp, err := http.Post(ts.URL+root+"/api/track?async=true", "text/plain", bytes.NewReader(c.body))
+		if err != nil {
+			t.Fatalf("Error creating the POST request, %s", err)
+		}
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("Expected 202, got %d", resp.StatusCode)
+		}
+		response := resJob{}
+		if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.Fatalf("Error decoding response, %s", err)
+		}
+		resp.Body.Close()
+
+		j := waitForJob(t, ts.URL, response.JobID)
+		if j.Status != c.status {
+			t.Errorf("Expected job %s, got %s (%s)", c.status, j.Status, j.Error)
+		}
+		if c.status == jobDone {
+			if j.TrackID == nil {
+				t.Fatal("Expected a track ID on the finished job")
+			}
+			if _, err = srv.store.Get(*j.TrackID); err != nil {
+				t.Errorf("Track %d of the job not stored, %s", *j.TrackID, err)
+			}
+		}
+		if len(j.Warnings) != c.warnings {
+			t.Errorf("Expected %d warnings on the job, got %+v", c.warnings, j.Warnings)
+		}
+		if c.status == jobFailed && j.Error == "" {
+			t.Error("Expected the parse error on the failed job")
+		}
+	}
+
+	resp, err := http.Get(ts.URL + root + "/api/jobs/unknown")
+	if err != nil {
+		t.Fatalf("Error creating the GET request, %s", err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown job, got %d", resp.StatusCode)
+	}
+}
+
+func TestResumeJobs(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/flight.igc")
+	if err != nil {
+		t.Fatalf("Error reading test flight, %s", err)
+	}
+
+	// a job left running by a previous process
+	srv := newTestServer()
+	_ = srv.store.InsertJob(job{ID: "left-over", Status: jobRunning, Content: content, Created: time.Now()})
+
+	srv.jobs = make(chan string, 10)
+	srv.startWorkers(1)
+	if err = srv.resumeJobs(); err != nil {
+		t.Fatalf("Error resuming jobs, %s", err)
+	}
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	j := waitForJob(t, ts.URL, "left-over")
+	if j.Status != jobDone || j.TrackID == nil {
+		t.Errorf("Expected the resumed job to finish, got %s (%s)", j.Status, j.Error)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/marni/goigc"
+)
+
+// content types of the KML and KMZ exports
+const (
+	kmlContentType = "application/vnd.google-earth.kml+xml"
+	kmzContentType = "application/vnd.google-earth.kmz"
+)
+
+// colours of the path, as KML aabbggrr
+const (
+	pathColour    = "ff00a5ff" // orange
+	extrudeColour = "4000a5ff"
+	markerTakeoff = "ff00ff00"
+	markerLanding = "ff0000ff"
+	markerThermal = "ff00ffff"
+)
+
+// the path is drawn wider when coloured by climb rate
+const climbLineWidth = 3
+
+// climbColours colour the path by climb rate: every class holds the climb
+// rates below its limit, in m/s
+var climbColours = []struct {
+	name   string
+	limit  float64
+	colour string
+}{
+	{"strong sink", -2, "ffff0000"},           // blue
+	{"sink", -0.5, "ffffff00"},                // cyan
+	{"zero", 0.5, "ff00ff00"},                 // green
+	{"climb", 2, "ff00ffff"},                  // yellow
+	{"strong climb", math.Inf(1), "ff0000ff"}, // red
+}
+
+// KML 2.2 document, see https://developers.google.com/kml/documentation/kmlreference
+type kmlDocument struct {
+	XMLName  xml.Name  `xml:"http://www.opengis.net/kml/2.2 kml"`
+	Document kmlFolder `xml:"Document"`
+}
+
+type kmlFolder struct {
+	Name        string         `xml:"name"`
+	Description string         `xml:"description,omitempty"`
+	Styles      []kmlStyle     `xml:"Style"`
+	Folders     []kmlFolder    `xml:"Folder"`
+	Placemarks  []kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlStyle struct {
+	ID        string        `xml:"id,attr"`
+	IconStyle *kmlIconStyle `xml:"IconStyle,omitempty"`
+	LineStyle *kmlLineStyle `xml:"LineStyle,omitempty"`
+	PolyStyle *kmlPolyStyle `xml:"PolyStyle,omitempty"`
+}
+
+type kmlIconStyle struct {
+	Colour string `xml:"color"`
+	Icon   string `xml:"Icon>href"`
+}
+
+type kmlLineStyle struct {
+	Colour string `xml:"color"`
+	Width  int    `xml:"width"`
+}
+
+type kmlPolyStyle struct {
+	Colour string `xml:"color"`
+}
+
+type kmlPlacemark struct {
+	Name        string         `xml:"name"`
+	Description string         `xml:"description,omitempty"`
+	StyleURL    string         `xml:"styleUrl"`
+	Point       *kmlPoint      `xml:"Point,omitempty"`
+	LineString  *kmlLineString `xml:"LineString,omitempty"`
+}
+
+type kmlPoint struct {
+	AltitudeMode string `xml:"altitudeMode"`
+	Coordinates  string `xml:"coordinates"`
+}
+
+type kmlLineString struct {
+	Extrude      int    `xml:"extrude"`
+	AltitudeMode string `xml:"altitudeMode"`
+	Coordinates  string `xml:"coordinates"`
+}
+
+// Builds the KML document of a track: the path as an extruded line at
+// absolute altitude, coloured by climb rate if byClimb is set, and
+// placemarks for the takeoff, the landing and the thermals
+func newKML(track igc.Track, id int, byClimb bool) kmlDocument {
+	fields := igcFields{TrackID: id, HDate: track.Date, Pilot: track.Pilot, Glider: track.GliderType, GliderID: track.GliderID}
+	flights := airborneSegments(track.Points)
+	alt := absoluteAltitudes(track.Points)
+
+	marker := func(id, colour string) kmlStyle {
+		return kmlStyle{ID: id, IconStyle: &kmlIconStyle{colour, "http://maps.google.com/mapfiles/kml/paddle/wht-blank.png"}}
+	}
+	doc := kmlFolder{
+		Name:        trackName(fields),
+		Description: gliderName(fields),
+		Styles: []kmlStyle{
+			{ID: "path", LineStyle: &kmlLineStyle{pathColour, 2}, PolyStyle: &kmlPolyStyle{extrudeColour}},
+			marker("takeoff", markerTakeoff),
+			marker("landing", markerLanding),
+			marker("thermal", markerThermal),
+		},
+		Folders:    make([]kmlFolder, 0),
+		Placemarks: make([]kmlPlacemark, 0),
+	}
+
+	path := kmlFolder{Name: "Flight path", Placemarks: make([]kmlPlacemark, 0)}
+	if byClimb {
+		for i, c := range climbColours {
+			doc.Styles = append(doc.Styles, kmlStyle{
+				ID:        fmt.Sprintf("climb%d", i),
+				LineStyle: &kmlLineStyle{c.colour, climbLineWidth},
+				PolyStyle: &kmlPolyStyle{extrudeColour},
+			})
+		}
+		path.Placemarks = climbPath(track.Points, alt)
+	} else if len(track.Points) > 0 {
+		path.Placemarks = append(path.Placemarks, kmlPlacemark{
+			Name:       "Track",
+			StyleURL:   "#path",
+			LineString: lineString(track.Points, alt),
+		})
+	}
+	doc.Folders = append(doc.Folders, path)
+
+	point := func(i int) *kmlPoint {
+		return &kmlPoint{"absolute", coordinates(track.Points[i:i+1], alt[i:i+1])}
+	}
+	for _, f := range flights {
+		doc.Placemarks = append(doc.Placemarks,
+			kmlPlacemark{
+				Name:        "Takeoff",
+				Description: track.Points[f.Takeoff].Time.Format("15:04:05"),
+				StyleURL:    "#takeoff",
+				Point:       point(f.Takeoff),
+			},
+			kmlPlacemark{
+				Name:        "Landing",
+				Description: track.Points[f.Landing].Time.Format("15:04:05"),
+				StyleURL:    "#landing",
+				Point:       point(f.Landing),
+			})
+	}
+
+	thermals := kmlFolder{Name: "Thermals", Placemarks: make([]kmlPlacemark, 0)}
+	for i, t := range detectThermals(track.Points, flights) {
+		thermals.Placemarks = append(thermals.Placemarks, kmlPlacemark{
+			Name: fmt.Sprintf("Thermal %d", i+1),
+			Description: fmt.Sprintf("%+.1f m/s, %.0f m gained in %d s turning %s",
+				t.AvgClimb, t.ExitAlt-t.EntryAlt, t.Duration, t.Direction),
+			StyleURL: "#thermal",
+			Point:    &kmlPoint{"absolute", fmt.Sprintf("%f,%f,%.0f", t.Lng, t.Lat, alt[t.last])},
+		})
+	}
+	doc.Folders = append(doc.Folders, thermals)
+
+	return kmlDocument{Document: doc}
+}
+
+// Splits the path where the climb rate changes colour, one placemark for
+// every stretch of the same colour
+func climbPath(points []igc.Point, alt []float64) []kmlPlacemark {
+	placemarks := make([]kmlPlacemark, 0)
+	start, class := 0, -1
+	for i := range points {
+		c := climbClass(points, alt, i)
+		if i == 0 {
+			class = c
+			continue
+		}
+		if c != class || i == len(points)-1 {
+			// stretches share their end fix, so the path has no gaps
+			placemarks = append(placemarks, kmlPlacemark{
+				Name:       climbColours[class].name,
+				StyleURL:   fmt.Sprintf("#climb%d", class),
+				LineString: lineString(points[start:i+1], alt[start:i+1]),
+			})
+			start, class = i, c
+		}
+	}
+	return placemarks
+}
+
+// Returns the index in climbColours of the climb rate at fix i
+func climbClass(points []igc.Point, alt []float64, i int) int {
+	vario := 0.0
+	from, to := rateSpan(points, i)
+	if seconds := points[to].Time.Sub(points[from].Time).Seconds(); seconds > 0 {
+		vario = (alt[to] - alt[from]) / seconds
+	}
+	c := 0
+	for vario >= climbColours[c].limit {
+		c++
+	}
+	return c
+}
+
+func lineString(points []igc.Point, alt []float64) *kmlLineString {
+	return &kmlLineString{Extrude: 1, AltitudeMode: "absolute", Coordinates: coordinates(points, alt)}
+}
+
+// Formats the fixes as KML coordinates: lng,lat,alt separated by spaces
+func coordinates(points []igc.Point, alt []float64) string {
+	var b strings.Builder
+	for i, p := range points {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%.6f,%.6f,%.0f", p.Lng.Degrees(), p.Lat.Degrees(), alt[i])
+	}
+	return b.String()
+}
+
+// Returns the altitude above sea level of every fix, in metres: GNSS
+// altitude, or pressure altitude when the recorder had no GNSS altitude
+func absoluteAltitudes(points []igc.Point) []float64 {
+	gnss := false
+	for _, p := range points {
+		if p.GNSSAltitude != 0 {
+			gnss = true
+			break
+		}
+	}
+	alt := make([]float64, len(points))
+	for i, p := range points {
+		if gnss {
+			alt[i] = float64(p.GNSSAltitude)
+		} else {
+			alt[i] = float64(p.PressureAltitude)
+		}
+	}
+	return alt
+}
+
+// Writes the KML document of the track
+func writeKML(w io.Writer, track igc.Track, id int, byClimb bool) error {
+	doc := newKML(track, id, byClimb)
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return encoder.Encode(&doc)
+}
+
+// GET api/track/<id>/kml exports the track for Google Earth.
+// ?colour=climb colours the path by climb rate.
+func (s *server) kmlHandler(w http.ResponseWriter, r *http.Request, fields igcFields) {
+	track, ok := s.loadTrack(w, fields)
+	if !ok {
+		return
+	}
+
+	attachment(w, fields, kmlContentType, "kml")
+	if err := writeKML(w, track, fields.TrackID, r.URL.Query().Get("colour") == "climb"); err != nil {
+		log.Printf("could not send kml of track %d: %v", fields.TrackID, err)
+	}
+}
+
+// GET api/track/<id>/kmz exports the track for Google Earth, as a zipped
+// KML document
+func (s *server) kmzHandler(w http.ResponseWriter, r *http.Request, fields igcFields) {
+	track, ok := s.loadTrack(w, fields)
+	if !ok {
+		return
+	}
+
+	// built in memory, so a failure can still be answered with 500
+	archive := &bytes.Buffer{}
+	z := zip.NewWriter(archive)
+	doc, err := z.Create("doc.kml")
+	if err == nil {
+		err = writeKML(doc, track, fields.TrackID, r.URL.Query().Get("colour") == "climb")
+	}
+	if err == nil {
+		err = z.Close()
+	}
+	if err != nil {
+		log.Printf("could not build kmz of track %d: %v", fields.TrackID, err)
+		status := 500
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	attachment(w, fields, kmzContentType, "kmz")
+	if _, err = archive.WriteTo(w); err != nil {
+		log.Printf("could not send kmz of track %d: %v", fields.TrackID, err)
+	}
+}
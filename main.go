@@ -2,11 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
-	"github.com/marni/goigc"
+	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
 	"strconv"
@@ -28,6 +29,14 @@ var dbCollection = "igcstruct"
 // Global variables and structs
 var startTime time.Time
 
+// server holds the dependencies shared by the handlers
+type server struct {
+	store    TrackStore
+	fetcher  *fetcher
+	jobs     chan string // IDs of jobs waiting for a worker
+	rulesets map[string]ruleset
+}
+
 // holds data for /igcinfo/api
 type meta struct {
 	Uptime  string `json:"uptime"`
@@ -45,41 +54,51 @@ type ticker struct {
 
 // holds data for /igcinfo/api/track/id
 type igcFields struct {
-	ID        bson.ObjectId `bson:"_id,omitempty" json:"-"`
-	TrackID   int           `bson:"id" json:"-"`
-	HDate     time.Time     `json:"H_date"`
-	Pilot     string        `json:"pilot"`
-	Glider    string        `json:"glider"`
-	GliderID  string        `json:"glider_id"`
-	TrackLen  float64       `json:"track_length"`
-	TrackURL  string        `json:"track_src_url"`
-	Timestamp time.Time     `bson:"timestamp" json:"-"`
+	ID           bson.ObjectId `bson:"_id,omitempty" json:"-"`
+	TrackID      int           `bson:"id" json:"-"`
+	HDate        time.Time     `json:"H_date"`
+	Timezone     float64       `bson:"timezone" json:"timezone"` // hours from UTC, for local times
+	Pilot        string        `json:"pilot"`
+	Glider       string        `json:"glider"`
+	GliderID     string        `json:"glider_id"`
+	TrackLen     float64       `json:"track_length"`
+	OptDistance  float64       `bson:"optimized_distance" json:"optimized_distance"`
+	FAITriangle  float64       `bson:"fai_triangle" json:"fai_triangle"`
+	FlatTriangle float64       `bson:"flat_triangle" json:"flat_triangle"`
+	TrackURL     string        `json:"track_src_url"`
+	Timestamp    time.Time     `bson:"timestamp" json:"-"`
+
+	flightStats `bson:",inline"`
+
+	// used to detect flights submitted twice
+	Hash        string `bson:"hash,omitempty" json:"-"`
+	Fingerprint string `bson:"fingerprint,omitempty" json:"-"`
+
+	// lines the parser skipped, reported to the client that submitted it
+	Warnings []parseWarning `bson:"-" json:"-"`
 }
 
 // the response type for POST /igcinfo/api/track
 type resID struct {
-	TrackID int `json:"id"`
+	TrackID  int            `json:"id"`
+	Warnings []parseWarning `json:"warnings,omitempty"`
 }
 
 type trackURLRequest struct {
 	URL string `json:"url"`
 }
 
-// This function finds the amount of docs in db, uses it to return
-//	an auto incremented ID
-func getIncrementedID() (int, error) {
-	var uniqueID int
-	session, err := mgo.Dial(dbURL)
-	if err != nil {
-		return uniqueID, err
-	}
-
-	defer session.Close()
-
-	uniqueID, err = session.DB(dbName).C(dbCollection).Count()
-
-	return uniqueID, err
+// error body for failures the client can act on
+type apiError struct {
+	Code    string `json:"error"`
+	Message string `json:"message"`
+}
 
+// Responds with status and an apiError in json
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(&apiError{Code: code, Message: message})
 }
 
 // Takes a Unix time difference and returns string of ISO 8601
@@ -103,7 +122,7 @@ func calculateDuration(t time.Duration) string {
 }
 
 // Handles  igcinfo/api and outputs metadata in json
-func metaHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) metaHandler(w http.ResponseWriter, r *http.Request) {
 	mt := meta{
 		Uptime:  calculateDuration(time.Since(startTime)),
 		Info:    "Service for Paragliding tracks.",
@@ -118,85 +137,19 @@ func metaHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// After a POST, url is passed here to parse a track-object
-func processURL(igcURL string, w http.ResponseWriter) (igcFields, error) {
-
-	fields := igcFields{}
-	track, err := igc.ParseLocation(igcURL)
-	if err != nil {
-
-		return fields, err
-	}
-
-	// Get unique ID
-	var uniqueID int
-	uniqueID, err = getIncrementedID()
-	if err != nil {
-		return fields, err
-	}
-
-	// Calculate total track distance
-	totalDistance := 0.0
-	for i := 0; i < len(track.Points)-1; i++ {
-		totalDistance += track.Points[i].Distance(track.Points[i+1])
-	}
-
-	fields = igcFields{
-		ID:        bson.NewObjectId(),
-		HDate:     track.Date,
-		TrackID:   uniqueID,
-		Pilot:     track.Pilot,
-		Glider:    track.GliderType,
-		GliderID:  track.GliderID,
-		TrackLen:  totalDistance,
-		TrackURL:  igcURL,
-		Timestamp: time.Now()}
-
-	// Response with ID as json and return the track
+// List array of IDs in json
+func (s *server) displayIDs(w http.ResponseWriter) {
 	http.Header.Add(w.Header(), "content-type", "application/json")
-	response := resID{fields.TrackID}
-	err = json.NewEncoder(w).Encode(&response)
-
-	return fields, err
-}
-
-// Add a track to the DB
-func addToDB(fields igcFields) {
-
-	session, err := mgo.Dial(dbURL)
-	if err != nil {
-		return
-	}
-
-	defer session.Close()
-
-	err = session.DB(dbName).C(dbCollection).Insert(fields)
 
+	items, err := s.store.List()
 	if err != nil {
+		status := 500
+		http.Error(w, http.StatusText(status), status)
 		return
 	}
-}
-
-// List array of IDs in json
-func displayIDs(w http.ResponseWriter) {
-	http.Header.Add(w.Header(), "content-type", "application/json")
-	session, err := mgo.Dial(dbURL)
-	if err != nil {
-		panic(err)
-	}
-	defer session.Close()
-
-	//session.SetMode(mgo.Monotonic, true)
-
-	c := session.DB(dbName).C(dbCollection)
-
-	item := igcFields{}
-
-	find := c.Find(bson.M{})
 
 	response := make([]int, 0)
-	items := find.Iter()
-	for items.Next(&item) {
+	for _, item := range items {
 		response = append(response, item.TrackID)
 	}
 
@@ -209,52 +162,68 @@ func displayIDs(w http.ResponseWriter) {
 
 }
 
-// Check for POST and GET requests. POSTs URL
-func inputHandler(w http.ResponseWriter, r *http.Request) {
+// Check for POST and GET requests. POSTs a URL, an uploaded file or a raw IGC body
+func (s *server) inputHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		displayIDs(w)
+		s.displayIDs(w)
 	case http.MethodPost:
-		/*if err := r.ParseForm(); err != nil {
+		http.Header.Add(w.Header(), "content-type", "application/json")
+		sub, err := readSubmission(w, r)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, fetchTooLarge,
+				fmt.Sprintf("request body exceeds %d bytes", maxUploadSize))
+			return
+		}
+		if err != nil {
+			status := 400
+			http.Error(w, http.StatusText(status), status)
 			return
 		}
 
-		icgURL := r.FormValue("url")*/
-		http.Header.Add(w.Header(), "content-type", "application/json")
-		req := trackURLRequest{}
-		err := json.NewDecoder(r.Body).Decode(&req)
+		if async, _ := strconv.ParseBool(r.URL.Query().Get("async")); async {
+			s.enqueueHandler(w, sub)
+			return
+		}
+
+		fields, err := s.ingest(sub)
+		if fe, ok := err.(*fetchError); ok {
+			writeError(w, fe.status(), fe.Code, fe.Err.Error())
+			return
+		}
+		if _, ok := err.(*parseError); ok {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if de, ok := err.(*duplicateError); ok {
+			// answer like the first submission when the client asks for it
+			status := http.StatusConflict
+			if idempotent, _ := strconv.ParseBool(r.URL.Query().Get("idempotent")); idempotent {
+				status = http.StatusOK
+			}
+			w.WriteHeader(status)
+			_ = json.NewEncoder(w).Encode(&resID{TrackID: de.TrackID})
+			return
+		}
 		if err != nil {
+			log.Print(err)
 			status := 500
 			http.Error(w, http.StatusText(status), status)
 			return
 		}
-		fields, err := processURL(req.URL, w)
-		if err != nil {
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+
+		// Response with ID as json
+		response := resID{TrackID: fields.TrackID, Warnings: fields.Warnings}
+		if err = json.NewEncoder(w).Encode(&response); err != nil {
+			status := 500
+			http.Error(w, http.StatusText(status), status)
 			return
 		}
-		addToDB(fields)
 
 	}
 }
 
-//	In /igcinfo/api/track/ID we use ID to find a track i db
-func getTrack(idOfTrack int) (igcFields, error) {
-	session, err := mgo.Dial(dbURL)
-	if err != nil {
-		panic(err)
-	}
-	defer session.Close()
-
-	c := session.DB(dbName).C(dbCollection)
-	response := igcFields{}
-
-	err = c.Find(bson.M{"id": idOfTrack}).One(&response)
-
-	return response, err
-
-}
-
 //	In /igcinfo/api/track/ID/FIELD we use ID to find a track i db
 //	and FIELD to display that field
 func getField(fields igcFields, field string, w http.ResponseWriter) {
@@ -268,10 +237,54 @@ func getField(fields igcFields, field string, w http.ResponseWriter) {
 		_, _ = fmt.Fprintln(w, fields.GliderID)
 	case "track_length":
 		_, _ = fmt.Fprintln(w, fields.TrackLen)
+	case "optimized_distance":
+		_, _ = fmt.Fprintln(w, fields.OptDistance)
+	case "fai_triangle":
+		_, _ = fmt.Fprintln(w, fields.FAITriangle)
+	case "flat_triangle":
+		_, _ = fmt.Fprintln(w, fields.FlatTriangle)
 	case "H_date":
 		_, _ = fmt.Fprintln(w, fields.HDate)
+	case "timezone":
+		_, _ = fmt.Fprintln(w, fields.Timezone)
 	case "track_src_url":
 		_, _ = fmt.Fprintln(w, fields.TrackURL)
+	case "takeoff_time":
+		_, _ = fmt.Fprintln(w, fields.TakeoffTime)
+	case "landing_time":
+		_, _ = fmt.Fprintln(w, fields.LandingTime)
+	case "duration":
+		_, _ = fmt.Fprintln(w, fields.Duration)
+	case "max_pressure_alt":
+		_, _ = fmt.Fprintln(w, fields.MaxPressAlt)
+	case "min_pressure_alt":
+		_, _ = fmt.Fprintln(w, fields.MinPressAlt)
+	case "max_gnss_alt":
+		_, _ = fmt.Fprintln(w, fields.MaxGNSSAlt)
+	case "min_gnss_alt":
+		_, _ = fmt.Fprintln(w, fields.MinGNSSAlt)
+	case "altitude_gain":
+		_, _ = fmt.Fprintln(w, fields.AltitudeGain)
+	case "max_climb":
+		_, _ = fmt.Fprintln(w, fields.MaxClimb)
+	case "max_sink":
+		_, _ = fmt.Fprintln(w, fields.MaxSink)
+	case "avg_speed":
+		_, _ = fmt.Fprintln(w, fields.AvgSpeed)
+	case "max_speed":
+		_, _ = fmt.Fprintln(w, fields.MaxSpeed)
+	case "fixes":
+		_, _ = fmt.Fprintln(w, fields.Fixes)
+	case "flights":
+		_, _ = fmt.Fprintln(w, fields.Flights)
+	case "circling_percent":
+		_, _ = fmt.Fprintln(w, fields.CirclingPercent)
+	case "avg_climb":
+		_, _ = fmt.Fprintln(w, fields.AvgClimb)
+	case "glide_ratio":
+		_, _ = fmt.Fprintln(w, fields.GlideRatio)
+	case "best_glide":
+		_, _ = fmt.Fprintln(w, fields.BestGlide)
 	default:
 		status := 404
 		http.Error(w, http.StatusText(status), status)
@@ -279,10 +292,26 @@ func getField(fields igcFields, field string, w http.ResponseWriter) {
 
 }
 
+// Sub-resources of /api/track/<id>/ that are served by their own handler
+// rather than as a plain <FIELD>
+var trackResources = map[string]func(s *server, w http.ResponseWriter, r *http.Request, fields igcFields){
+	"igc":      (*server).igcHandler,
+	"thermals": (*server).thermalsHandler,
+	"glides":   (*server).glidesHandler,
+	"score":    (*server).scoreHandler,
+	"task":     (*server).taskHandler,
+	"gpx":      (*server).gpxHandler,
+	"kml":      (*server).kmlHandler,
+	"kmz":      (*server).kmzHandler,
+	"geojson":  (*server).geojsonHandler,
+	"polyline": (*server).polylineHandler,
+	"points":   (*server).pointsHandler,
+}
+
 //	Handles the last two arguments for <ID> and <FIELD>
 //
 //
-func argsHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) argsHandler(w http.ResponseWriter, r *http.Request) {
 
 	parts := strings.Split(r.URL.Path, "/") // array of url parts
 	fields := igcFields{}
@@ -294,7 +323,6 @@ func argsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(parts) > idArg {
-		http.Header.Add(w.Header(), "content-type", "application/json")
 		idOfTrack, err := strconv.Atoi(parts[idArg])
 		if err != nil {
 			status := 400
@@ -302,7 +330,7 @@ func argsHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		fields, err = getTrack(idOfTrack)
+		fields, err = s.store.Get(idOfTrack)
 		if err != nil {
 			status := 400
 			http.Error(w, http.StatusText(status), status)
@@ -310,6 +338,7 @@ func argsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if len(parts) < fieldArg+1 {
+			http.Header.Add(w.Header(), "content-type", "application/json")
 			if err := json.NewEncoder(w).Encode(&fields); err != nil {
 				status := 500
 				http.Error(w, http.StatusText(status), status)
@@ -321,22 +350,43 @@ func argsHandler(w http.ResponseWriter, r *http.Request) {
 	if len(parts) > fieldArg {
 
 		field := parts[fieldArg]
+		if resource, ok := trackResources[field]; ok {
+			resource(s, w, r, fields)
+			return
+		}
 		getField(fields, field, w)
 	}
 }
 
-// Returns the amount of documents in the DB
-func countHandler(w http.ResponseWriter, r *http.Request) {
-	var docs int
-	session, err := mgo.Dial(dbURL)
+// GET api/track/<id>/igc streams the original IGC file
+func (s *server) igcHandler(w http.ResponseWriter, r *http.Request, fields igcFields) {
+	file, name, err := s.store.OpenIGC(fields.TrackID)
+	if err == errIGCNotFound {
+		status := 404
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
 	if err != nil {
-		panic(err)
+		status := 500
+		http.Error(w, http.StatusText(status), status)
+		return
 	}
+	defer file.Close()
 
-	defer session.Close()
+	if name == "" || name == "." || name == "/" {
+		name = strconv.Itoa(fields.TrackID) + ".igc"
+	}
 
-	docs, err = session.DB(dbName).C(dbCollection).Count()
+	http.Header.Add(w.Header(), "content-type", igcContentType)
+	http.Header.Add(w.Header(), "content-disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	if _, err = io.Copy(w, file); err != nil {
+		log.Printf("could not send igc file of track %d: %v", fields.TrackID, err)
+	}
+}
 
+// Returns the amount of documents in the DB
+func (s *server) countHandler(w http.ResponseWriter, r *http.Request) {
+	docs, err := s.store.Count()
 	if err != nil {
 		status := 500
 		http.Error(w, http.StatusText(status), status)
@@ -354,17 +404,10 @@ func countHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Deletes all documents in the DB collection
-func deleteAll(w http.ResponseWriter, r *http.Request) {
+func (s *server) deleteAll(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == http.MethodDelete {
-		session, err := mgo.Dial(dbURL)
-		if err != nil {
-			panic(err)
-		}
-
-		defer session.Close()
-
-		_, err = session.DB(dbName).C(dbCollection).RemoveAll(bson.M{})
+		err := s.store.DeleteAll()
 		if err != nil {
 			status := 500
 			http.Error(w, http.StatusText(status), status)
@@ -374,37 +417,18 @@ func deleteAll(w http.ResponseWriter, r *http.Request) {
 }
 
 // GET api/ticker
-func tickerHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) tickerHandler(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	t := ticker{}
 
-	session, err := mgo.Dial(dbURL)
-	if err != nil {
-		panic(err)
-	}
-	defer session.Close()
-
-	//session.SetMode(mgo.Monotonic, true)
-
-	c := session.DB(dbName).C(dbCollection)
-	latestID, err := session.DB(dbName).C(dbCollection).Count()
-	if err != nil {
-		status := 500
-		http.Error(w, http.StatusText(status), status)
-		return
-	}
-
-	latestID--
-	latestTrack, err := getTrack(latestID)
+	latestTrack, err := s.store.Latest()
 	if err != nil {
 		status := 404
 		http.Error(w, http.StatusText(status), status)
 		return
 	}
 
-	items := []igcFields{}
-
-	err = c.Find(bson.M{}).Sort("timestamp").Limit(5).All(&items)
+	items, err := s.store.Range(time.Time{}, time.Time{}, 5)
 	if err != nil {
 		status := 500
 		http.Error(w, http.StatusText(status), status)
@@ -441,7 +465,7 @@ func tickerHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func tickerTimestampHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) tickerTimestampHandler(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
 	parts := strings.Split(r.URL.Path, "/") // array of url parts
@@ -457,24 +481,7 @@ func tickerTimestampHandler(w http.ResponseWriter, r *http.Request) {
 
 	t := ticker{}
 
-	session, err := mgo.Dial(dbURL)
-	if err != nil {
-		panic(err)
-	}
-	defer session.Close()
-
-	//session.SetMode(mgo.Monotonic, true)
-
-	c := session.DB(dbName).C(dbCollection)
-	latestID, err := session.DB(dbName).C(dbCollection).Count()
-	if err != nil {
-		status := 500
-		http.Error(w, http.StatusText(status), status)
-		return
-	}
-
-	latestID--
-	latestTrack, err := getTrack(latestID)
+	latestTrack, err := s.store.Latest()
 	if err != nil {
 		status := 404
 		http.Error(w, http.StatusText(status), status)
@@ -484,14 +491,7 @@ func tickerTimestampHandler(w http.ResponseWriter, r *http.Request) {
 	fromDate := argTime
 	toDate := latestTrack.Timestamp
 
-	items := []igcFields{}
-	err = c.Find(
-		bson.M{
-			"timestamp": bson.M{
-				"$gt":  fromDate,
-				"$lte": toDate,
-			},
-		}).Limit(5).All(&items)
+	items, err := s.store.Range(fromDate, toDate, 5)
 	if err != nil {
 		status := 404
 		http.Error(w, http.StatusText(status), status)
@@ -528,6 +528,34 @@ func tickerTimestampHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// Registers the handlers of the API
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(root+"/api", s.metaHandler)
+	mux.HandleFunc(root+"/api/track", s.inputHandler)
+	mux.HandleFunc(root+"/api/track/", s.argsHandler)
+	mux.HandleFunc(root+"/api/geojson", s.collectionHandler)
+	mux.HandleFunc(root+"/admin/api/tracks_count", s.countHandler)
+	mux.HandleFunc(root+"/admin/api/tracks", s.deleteAll)
+	mux.HandleFunc(root+"/admin/api/import", s.importHandler)
+	mux.HandleFunc(root+"/api/ticker", s.tickerHandler)
+	mux.HandleFunc(root+"/api/ticker/", s.tickerTimestampHandler)
+	mux.HandleFunc(root+"/api/jobs/", s.jobHandler)
+	return mux
+}
+
+// Picks the TrackStore implementation from $TRACK_STORE ("mongo" or "memory")
+func newStore(kind string) (TrackStore, error) {
+	switch kind {
+	case "", "mongo":
+		return newMongoStore(dbURL, dbName, dbCollection)
+	case "memory":
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown track store %q", kind)
+	}
+}
+
 // Main program
 func main() {
 	startTime = time.Now()
@@ -537,13 +565,41 @@ func main() {
 		log.Fatal("$PORT must be set")
 	}
 
-	http.HandleFunc(root+"/api", metaHandler)
-	http.HandleFunc(root+"/api/track", inputHandler)
-	http.HandleFunc(root+"/api/track/", argsHandler)
-	http.HandleFunc(root+"/admin/api/tracks_count", countHandler)
-	http.HandleFunc(root+"/admin/api/tracks", deleteAll)
-	http.HandleFunc(root+"/api/ticker", tickerHandler)
-	http.HandleFunc(root+"/api/ticker/", tickerTimestampHandler)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	if uri := os.Getenv("MONGODB_URI"); uri != "" {
+		dbURL = uri
+	}
+
+	store, err := newStore(os.Getenv("TRACK_STORE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	config, err := fetchConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	workers, queueSize, err := queueConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if closing := os.Getenv("TRIANGLE_CLOSING"); closing != "" {
+		if triangleClosing, err = strconv.ParseFloat(closing, 64); err != nil {
+			log.Fatalf("invalid $TRIANGLE_CLOSING: %v", err)
+		}
+	}
+	rulesetDir := os.Getenv("RULESETS_DIR")
+	if rulesetDir == "" {
+		rulesetDir = "rulesets"
+	}
+	rulesets, err := loadRulesets(rulesetDir)
+	if err != nil {
+		log.Fatalf("could not load rulesets: %v", err)
+	}
+	s := &server{store: store, fetcher: newFetcher(config), jobs: make(chan string, queueSize), rulesets: rulesets}
+	s.startWorkers(workers)
+	if err = s.resumeJobs(); err != nil {
+		log.Fatalf("could not load pending jobs: %v", err)
+	}
+
+	log.Fatal(http.ListenAndServe(":"+port, s.routes()))
 
 }
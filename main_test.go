@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"net/url"
 )
 
 func TestTrackParse(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(inputHandler))
+	srv := newTestServer()
+	ts := httptest.NewServer(http.HandlerFunc(srv.inputHandler))
 	defer ts.Close()
 
 	testURL := "http://skypolaris.org/wp-content/uploads/IGS%20Files/Madrid%20to%20Jerez.igc"
@@ -32,3 +41,238 @@ func TestTrackParse(t *testing.T) {
 	}
 
 }
+
+func TestTrackUpload(t *testing.T) {
+	srv := newTestServer()
+	ts := httptest.NewServer(http.HandlerFunc(srv.inputHandler))
+	defer ts.Close()
+
+	content, err := ioutil.ReadFile("testdata/flight.igc")
+	if err != nil {
+		t.Fatalf("Error reading test flight, %s", err)
+	}
+
+	// multipart form
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, _ := form.CreateFormFile(uploadField, "flight.igc")
+	_, _ = part.Write(content)
+	_ = form.Close()
+
+	resp, err := http.Post(ts.URL, form.FormDataContentType(), body)
+	if err != nil {
+		t.Fatalf("Error creating the POST request, %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected file upload to be accepted, got %d", resp.StatusCode)
+	}
+
+	response := resID{}
+	if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("Error decoding response, %s", err)
+	}
+	track, err := srv.store.Get(response.TrackID)
+	if err != nil {
+		t.Fatalf("Uploaded track %d not stored, %s", response.TrackID, err)
+	}
+	if track.Pilot != "Jane Doe" {
+		t.Errorf("Stored track does not match the upload, pilot %q", track.Pilot)
+	}
+
+	// the same flight as a raw body, saved with other line endings
+	unix := bytes.Replace(content, []byte("\r\n"), []byte("\n"), -1)
+	for _, c := range []struct {
+		query  string
+		status int
+	}{
+		{"", http.StatusConflict},
+		{"?idempotent=true", http.StatusOK},
+	} {
+		resp, err = http.Post(ts.URL+c.query, "text/plain", bytes.NewReader(unix))
+		if err != nil {
+			t.Fatalf("Error creating the POST request, %s", err)
+		}
+		if resp.StatusCode != c.status {
+			t.Errorf("Expected %d for a duplicate upload%s, got %d", c.status, c.query, resp.StatusCode)
+		}
+		duplicate := resID{}
+		if err = json.NewDecoder(resp.Body).Decode(&duplicate); err != nil || duplicate.TrackID != response.TrackID {
+			t.Errorf("Expected the existing track %d, got %d (%v)", response.TrackID, duplicate.TrackID, err)
+		}
+	}
+	if n, _ := srv.store.Count(); n != 1 {
+		t.Errorf("Expected the duplicate not to be stored, got %d tracks", n)
+	}
+
+	resp, err = http.Post(ts.URL, "text/plain", strings.NewReader("not an igc file"))
+	if err != nil {
+		t.Fatalf("Error creating the POST request, %s", err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		t.Error("Expected bad request")
+	}
+
+	// over the upload limit, as a raw body and as a form
+	large := bytes.Repeat([]byte("B"), maxUploadSize+1)
+	body = &bytes.Buffer{}
+	form = multipart.NewWriter(body)
+	part, _ = form.CreateFormFile(uploadField, "large.igc")
+	_, _ = part.Write(large)
+	_ = form.Close()
+	for contentType, content := range map[string][]byte{"text/plain": large, form.FormDataContentType(): body.Bytes()} {
+		resp, err = http.Post(ts.URL, contentType, bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("Error creating the POST request, %s", err)
+		}
+		apiErr := apiError{}
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestEntityTooLarge || apiErr.Code != fetchTooLarge {
+			t.Errorf("Expected 413 too_large for a %s body over the limit, got %d %+v", contentType, resp.StatusCode, apiErr)
+		}
+	}
+}
+
+func TestTrackUploadWarnings(t *testing.T) {
+	srv := newTestServer()
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	// a site header the parser doesn't know and a broken fix
+	content := "AXXX001\r\nHFDTE170818\r\nHFSITSITE:Fiesch\r\n" +
+		"B1000004600000N00800000EA0100001000\r\nB100002460\r\nB1000044600200N00800000EA0100401040\r\n"
+	resp, err := http.Post(ts.URL+root+"/api/track", "text/plain", strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Error creating the POST request, %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the file to be accepted, got %d", resp.StatusCode)
+	}
+	response := resID{}
+	if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("Error decoding response, %s", err)
+	}
+	if len(response.Warnings) != 2 || response.Warnings[0].Line != 3 || response.Warnings[0].Record != "H" ||
+		response.Warnings[1].Line != 5 || response.Warnings[1].Record != "B" {
+		t.Errorf("Expected warnings for lines 3 and 5, got %+v", response.Warnings)
+	}
+
+	// the stored file is read the same way
+	fixes := make([]trackFix, 0)
+	getJSON(t, ts.URL+root+"/api/track/"+strconv.Itoa(response.TrackID)+"/points", jsonContentType, &fixes)
+	if len(fixes) != 2 {
+		t.Errorf("Expected the 2 valid fixes, got %d", len(fixes))
+	}
+}
+
+func TestTrackIGC(t *testing.T) {
+	srv := newTestServer()
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	content, err := ioutil.ReadFile("testdata/flight.igc")
+	if err != nil {
+		t.Fatalf("Error reading test flight, %s", err)
+	}
+	id := uploadFlight(t, ts.URL, "testdata/flight.igc")
+
+	resp, err := http.Get(ts.URL + root + "/api/track/" + strconv.Itoa(id) + "/igc")
+	if err != nil {
+		t.Fatalf("Error creating the GET request, %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the igc file, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("content-type"); ct != igcContentType {
+		t.Errorf("Expected content type %s, got %s", igcContentType, ct)
+	}
+	if cd := resp.Header.Get("content-disposition"); cd != `attachment; filename=flight.igc` {
+		t.Errorf("Unexpected content disposition %s", cd)
+	}
+	served, _ := ioutil.ReadAll(resp.Body)
+	if !bytes.Equal(served, content) {
+		t.Error("Served file differs from the upload")
+	}
+}
+
+// Uploads the IGC file to the API served at baseURL and returns the new track ID
+func uploadFlight(t *testing.T, baseURL string, file string) int {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Error reading %s, %s", file, err)
+	}
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, _ := form.CreateFormFile(uploadField, path.Base(file))
+	_, _ = part.Write(content)
+	_ = form.Close()
+
+	resp, err := http.Post(baseURL+root+"/api/track", form.FormDataContentType(), body)
+	if err != nil {
+		t.Fatalf("Error creating the POST request, %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Upload of %s failed with %d", file, resp.StatusCode)
+	}
+	response := resID{}
+	if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("Error decoding response, %s", err)
+	}
+	return response.TrackID
+}
+
+// Returns a server with an empty memory store, allowed to fetch from local test servers
+func newTestServer() *server {
+	config := fetchConfig{Timeout: 5 * time.Second, MaxBytes: maxUploadSize, MaxRedirects: 5, AllowPrivate: true}
+	rulesets, _ := loadRulesets("rulesets")
+	return &server{store: newMemoryStore(), fetcher: newFetcher(config), rulesets: rulesets}
+}
+
+func TestTrackFields(t *testing.T) {
+	srv := newTestServer()
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	id := uploadFlight(t, ts.URL, "testdata/flight.igc")
+	trackURL := ts.URL + root + "/api/track/" + strconv.Itoa(id)
+
+	resp, err := http.Get(trackURL)
+	if err != nil {
+		t.Fatalf("Error creating the GET request, %s", err)
+	}
+	track := map[string]interface{}{}
+	err = json.NewDecoder(resp.Body).Decode(&track)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Error decoding track, %s", err)
+	}
+	for _, field := range []string{"pilot", "track_length", "optimized_distance", "fai_triangle", "flat_triangle", "takeoff_time", "duration", "max_climb", "fixes"} {
+		if _, ok := track[field]; !ok {
+			t.Errorf("Expected %s in the track", field)
+		}
+	}
+
+	resp, err = http.Get(trackURL + "/flights")
+	if err != nil {
+		t.Fatalf("Error creating the GET request, %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.TrimSpace(string(body)) != "1" {
+		t.Errorf("Expected 1 flight, got %q", body)
+	}
+
+	resp, err = http.Get(trackURL + "/unknown")
+	if err != nil {
+		t.Fatalf("Error creating the GET request, %s", err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown field, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// how long to wait for the database when the service starts
+const mongoDialTimeout = 10 * time.Second
+
+// collection holding the sequence documents used for ID allocation
+const counterCollection = "counters"
+
+// _id of the counter document for track IDs. Its seq field holds the
+// last track ID handed out.
+const trackCounter = "trackid"
+
+// prefix of the GridFS collections holding the original IGC files
+const gridFSPrefix = "igcfiles"
+
+// content type of the stored IGC files
+const igcContentType = "application/vnd.fai.igc"
+
+// collection holding the ingestion jobs
+const jobCollection = "jobs"
+
+// a document of the counter collection
+type counter struct {
+	Name string `bson:"_id"`
+	Seq  int    `bson:"seq"`
+}
+
+// mongoStore is a TrackStore backed by a MongoDB collection.
+// It keeps one long-lived session and copies it for every operation,
+// so requests share the driver's connection pool.
+type mongoStore struct {
+	session    *mgo.Session
+	db         string
+	collection string
+}
+
+// Dials the database, checks it answers and makes sure the indexes the
+// queries rely on exist
+func newMongoStore(url, db, collection string) (*mongoStore, error) {
+	session, err := mgo.DialWithTimeout(url, mongoDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to MongoDB: %v", err)
+	}
+
+	if err = session.Ping(); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("MongoDB did not answer ping: %v", err)
+	}
+
+	m := &mongoStore{session: session, db: db, collection: collection}
+	if err = m.seedCounter(); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("could not initialise the track ID counter: %v", err)
+	}
+
+	if err = m.fixDuplicateIDs(); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("could not renumber duplicate track IDs: %v", err)
+	}
+
+	if err = m.ensureIndexes(); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("could not create indexes: %v", err)
+	}
+
+	return m, nil
+}
+
+// Creates the unique index on the track ID, the index on the timestamp
+// used by the ticker, the unique indexes that keep duplicate flights out
+// and the index used to find pending jobs
+func (m *mongoStore) ensureIndexes() error {
+	session, c := m.copy()
+	defer session.Close()
+
+	err := c.EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true})
+	if err != nil {
+		return err
+	}
+	if err = c.EnsureIndex(mgo.Index{Key: []string{"timestamp"}}); err != nil {
+		return err
+	}
+	for _, key := range []string{"hash", "fingerprint"} {
+		if err = c.EnsureIndex(mgo.Index{Key: []string{key}, Unique: true, Sparse: true}); err != nil {
+			return err
+		}
+	}
+	return session.DB(m.db).C(jobCollection).EnsureIndex(mgo.Index{Key: []string{"status", "created"}})
+}
+
+// Returns a copy of the shared session with the track collection.
+// The caller is responsible for closing the session.
+func (m *mongoStore) copy() (*mgo.Session, *mgo.Collection) {
+	session := m.session.Copy()
+	return session, session.DB(m.db).C(m.collection)
+}
+
+// Creates the track ID counter if it does not exist yet. It starts at the
+// highest ID already stored, so tracks added before the counter existed
+// (when IDs came from Count) are never handed out again.
+func (m *mongoStore) seedCounter() error {
+	session, c := m.copy()
+	defer session.Close()
+	counters := session.DB(m.db).C(counterCollection)
+
+	n, err := counters.FindId(trackCounter).Count()
+	if err != nil || n > 0 {
+		return err
+	}
+
+	highest := igcFields{TrackID: -1}
+	err = c.Find(nil).Sort("-id").One(&highest)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+
+	err = counters.Insert(counter{Name: trackCounter, Seq: highest.TrackID})
+	if mgo.IsDup(err) {
+		// another instance seeded it first
+		return nil
+	}
+	return err
+}
+
+// Migration for collections filled before IDs were allocated atomically.
+// For every ID used by more than one track, the oldest track keeps it and
+// the others get fresh IDs from the counter. It must run before the unique
+// index is created.
+func (m *mongoStore) fixDuplicateIDs() error {
+	session, c := m.copy()
+	defer session.Close()
+
+	var groups []struct {
+		ID   int             `bson:"_id"`
+		Docs []bson.ObjectId `bson:"docs"`
+	}
+	pipeline := []bson.M{
+		{"$sort": bson.M{"timestamp": 1}},
+		{"$group": bson.M{"_id": "$id", "docs": bson.M{"$push": "$_id"}, "n": bson.M{"$sum": 1}}},
+		{"$match": bson.M{"n": bson.M{"$gt": 1}}},
+	}
+	if err := c.Pipe(pipeline).All(&groups); err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		for _, doc := range g.Docs[1:] {
+			id, err := m.NextID()
+			if err != nil {
+				return err
+			}
+			if err = c.UpdateId(doc, bson.M{"$set": bson.M{"id": id}}); err != nil {
+				return err
+			}
+			log.Printf("renumbered duplicate track %d to %d", g.ID, id)
+		}
+	}
+	return nil
+}
+
+// Close releases the shared session
+func (m *mongoStore) Close() {
+	m.session.Close()
+}
+
+// Increments the counter document with findAndModify, so concurrent
+// callers always get distinct IDs
+func (m *mongoStore) NextID() (int, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	result := counter{}
+	change := mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"seq": 1}},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	_, err := session.DB(m.db).C(counterCollection).FindId(trackCounter).Apply(change, &result)
+	return result.Seq, err
+}
+
+func (m *mongoStore) Insert(fields igcFields) error {
+	session, c := m.copy()
+	defer session.Close()
+
+	err := c.Insert(fields)
+	if isDupKey(err, "id") {
+		return errDuplicateTrackID
+	}
+	if mgo.IsDup(err) {
+		// the hash or fingerprint index
+		return errDuplicateFlight
+	}
+	return err
+}
+
+// Tells if err is a duplicate key error on the index of the given key
+func isDupKey(err error, key string) bool {
+	return mgo.IsDup(err) && strings.Contains(err.Error(), " "+key+"_1 ")
+}
+
+func (m *mongoStore) Get(id int) (igcFields, error) {
+	response := igcFields{}
+	session, c := m.copy()
+	defer session.Close()
+
+	err := c.Find(bson.M{"id": id}).One(&response)
+	if err == mgo.ErrNotFound {
+		err = errTrackNotFound
+	}
+	return response, err
+}
+
+func (m *mongoStore) Latest() (igcFields, error) {
+	response := igcFields{}
+	session, c := m.copy()
+	defer session.Close()
+
+	err := c.Find(nil).Sort("-timestamp").One(&response)
+	if err == mgo.ErrNotFound {
+		err = errTrackNotFound
+	}
+	return response, err
+}
+
+func (m *mongoStore) FindDuplicate(hash, fingerprint string) (igcFields, error) {
+	response := igcFields{}
+	session, c := m.copy()
+	defer session.Close()
+
+	or := []bson.M{}
+	if hash != "" {
+		or = append(or, bson.M{"hash": hash})
+	}
+	if fingerprint != "" {
+		or = append(or, bson.M{"fingerprint": fingerprint})
+	}
+	if len(or) == 0 {
+		return response, errTrackNotFound
+	}
+
+	err := c.Find(bson.M{"$or": or}).One(&response)
+	if err == mgo.ErrNotFound {
+		err = errTrackNotFound
+	}
+	return response, err
+}
+
+func (m *mongoStore) List() ([]igcFields, error) {
+	items := []igcFields{}
+	session, c := m.copy()
+	defer session.Close()
+
+	err := c.Find(bson.M{}).All(&items)
+	return items, err
+}
+
+func (m *mongoStore) Count() (int, error) {
+	session, c := m.copy()
+	defer session.Close()
+
+	return c.Count()
+}
+
+func (m *mongoStore) DeleteAll() error {
+	session, c := m.copy()
+	defer session.Close()
+
+	_, err := c.RemoveAll(bson.M{})
+	if err != nil {
+		return err
+	}
+
+	gfs := session.DB(m.db).GridFS(gridFSPrefix)
+	if _, err = gfs.Files.RemoveAll(nil); err != nil {
+		return err
+	}
+	_, err = gfs.Chunks.RemoveAll(nil)
+	return err
+}
+
+// Writes the file to GridFS with the track ID as the file _id
+func (m *mongoStore) PutIGC(id int, name string, content []byte) error {
+	session := m.session.Copy()
+	defer session.Close()
+
+	file, err := session.DB(m.db).GridFS(gridFSPrefix).Create(name)
+	if err != nil {
+		return err
+	}
+	file.SetId(id)
+	file.SetContentType(igcContentType)
+
+	if _, err = file.Write(content); err != nil {
+		file.Abort()
+		_ = file.Close()
+		return err
+	}
+	err = file.Close()
+	if mgo.IsDup(err) {
+		return errDuplicateTrackID
+	}
+	return err
+}
+
+func (m *mongoStore) DeleteIGC(id int) error {
+	session := m.session.Copy()
+	defer session.Close()
+
+	err := session.DB(m.db).GridFS(gridFSPrefix).RemoveId(id)
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
+	return err
+}
+
+func (m *mongoStore) OpenIGC(id int) (io.ReadCloser, string, error) {
+	session := m.session.Copy()
+
+	file, err := session.DB(m.db).GridFS(gridFSPrefix).OpenId(id)
+	if err != nil {
+		session.Close()
+		if err == mgo.ErrNotFound {
+			err = errIGCNotFound
+		}
+		return nil, "", err
+	}
+	return &gridFile{file, session}, file.Name(), nil
+}
+
+// gridFile closes the session it was read with along with the file
+type gridFile struct {
+	*mgo.GridFile
+	session *mgo.Session
+}
+
+func (f *gridFile) Close() error {
+	defer f.session.Close()
+	return f.GridFile.Close()
+}
+
+func (m *mongoStore) Range(from, to time.Time, limit int) ([]igcFields, error) {
+	items := []igcFields{}
+	session, c := m.copy()
+	defer session.Close()
+
+	bounds := bson.M{"$gt": from}
+	if !to.IsZero() {
+		bounds["$lte"] = to
+	}
+
+	query := c.Find(bson.M{"timestamp": bounds}).Sort("timestamp")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	err := query.All(&items)
+	return items, err
+}
+
+func (m *mongoStore) InsertJob(j job) error {
+	session := m.session.Copy()
+	defer session.Close()
+
+	return session.DB(m.db).C(jobCollection).Insert(j)
+}
+
+func (m *mongoStore) UpdateJob(j job) error {
+	session := m.session.Copy()
+	defer session.Close()
+
+	err := session.DB(m.db).C(jobCollection).UpdateId(j.ID, j)
+	if err == mgo.ErrNotFound {
+		err = errJobNotFound
+	}
+	return err
+}
+
+func (m *mongoStore) GetJob(id string) (job, error) {
+	j := job{}
+	session := m.session.Copy()
+	defer session.Close()
+
+	err := session.DB(m.db).C(jobCollection).FindId(id).One(&j)
+	if err == mgo.ErrNotFound {
+		err = errJobNotFound
+	}
+	return j, err
+}
+
+func (m *mongoStore) PendingJobs() ([]job, error) {
+	pending := []job{}
+	session := m.session.Copy()
+	defer session.Close()
+
+	query := bson.M{"status": bson.M{"$in": []string{jobQueued, jobRunning}}}
+	err := session.DB(m.db).C(jobCollection).Find(query).Sort("created").All(&pending)
+	return pending, err
+}
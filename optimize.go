@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+
+	"github.com/marni/goigc"
+)
+
+// turnpoints of the free distance stored with every track
+const freeTurnpoints = 3
+
+// optimizer used for the free distance of the tracks
+var freeDistanceOptimizer = igc.NewFreeDistanceOptimizer()
+
+// largest gap between the start and finish of the triangles stored with
+// every track, in percent of the triangle distance. Set by
+// $TRIANGLE_CLOSING.
+var triangleClosing = 20.0
+
+// Returns the free distance of the flights, in km: the longest path from a
+// start through up to freeTurnpoints turnpoints to a finish, all taken
+// from the fixes between the first takeoff and the last landing
+func optimizedDistance(track igc.Track, flights []flightSegment) float64 {
+	if len(flights) == 0 {
+		return 0
+	}
+	track = airborneTrack(track, flights)
+
+	task, err := freeDistanceOptimizer.Optimize(track, freeTurnpoints, igc.Distance)
+	if err != nil {
+		log.Printf("could not optimize the distance: %v", err)
+		return 0
+	}
+	return task.Distance()
+}
+
+// Returns the distance of the largest closed triangle of the flights, in
+// km, or 0 if there is none. With fai set only FAI triangles count.
+func triangleDistance(track igc.Track, flights []flightSegment, fai bool) float64 {
+	if len(flights) == 0 {
+		return 0
+	}
+	track = airborneTrack(track, flights)
+
+	task, err := igc.NewTriangleOptimizer(fai, triangleClosing).Optimize(track, 3, igc.TriangleDistance)
+	if err != nil {
+		log.Printf("could not optimize the triangle: %v", err)
+		return 0
+	}
+	return igc.TriangleDistance(task)
+}
+
+// Returns the track cut to the fixes between the first takeoff and the
+// last landing of the flights, which must not be empty
+func airborneTrack(track igc.Track, flights []flightSegment) igc.Track {
+	track.Points = track.Points[flights[0].Takeoff : flights[len(flights)-1].Landing+1]
+	return track
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestOptimizedDistance(t *testing.T) {
+	track := parseTestFlight(t, "testdata/flight.igc")
+	flights := airborneSegments(track.Points)
+
+	// three glides of about 10km, out and back to launch, plus the drift
+	// in the thermals
+	d := optimizedDistance(track, flights)
+	if d < 31 || d > 34 {
+		t.Errorf("Expected about 32km of free distance, got %.2f", d)
+	}
+	if length := trackDistance(track.Points[flights[0].Takeoff : flights[0].Landing+1]); d > length {
+		t.Errorf("Expected at most the track length %.2f, got %.2f", length, d)
+	}
+
+	if d := optimizedDistance(track, nil); d != 0 {
+		t.Errorf("Expected 0 without a flight, got %.2f", d)
+	}
+}
+
+func TestTriangleDistance(t *testing.T) {
+	track := parseTestFlight(t, "testdata/flight.igc")
+	flights := airborneSegments(track.Points)
+	// out to the second thermal, across to the third and back to launch,
+	// legs of about 11km
+	fai := triangleDistance(track, flights, true)
+	if fai < 30 || fai > 34 {
+		t.Errorf("Expected an FAI triangle of about 32km, got %.2f", fai)
+	}
+	if flat := triangleDistance(track, flights, false); flat < fai {
+		t.Errorf("Expected a flat triangle of at least %.2f, got %.2f", fai, flat)
+	}
+
+	// the glide out alone doesn't close
+	flights = []flightSegment{{flights[0].Takeoff, flights[0].Takeoff + 700}}
+	if d := triangleDistance(track, flights, false); d > 5 {
+		t.Errorf("Expected no large triangle on the way out, got %.2f", d)
+	}
+}
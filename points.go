@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+// formats of the fix export, by content type
+const (
+	csvContentType  = "text/csv"
+	jsonContentType = "application/json"
+)
+
+// trackFix is a B record of a track, with the rates derived from the fixes
+// around it. Altitudes are in metres, the vario in m/s, the ground speed
+// in km/h and the heading in degrees clockwise from north.
+type trackFix struct {
+	Time        time.Time         `json:"time"`
+	Lat         float64           `json:"lat"`
+	Lng         float64           `json:"lng"`
+	PressureAlt int64             `json:"pressure_alt"`
+	GNSSAlt     int64             `json:"gnss_alt"`
+	Validity    string            `json:"validity"` // "A" for a 3D fix, "V" for 2D or none
+	Satellites  int               `json:"satellites"`
+	Extensions  map[string]string `json:"extensions"` // I record fields, by three letter code
+	Vario       float64           `json:"vario"`
+	GroundSpeed float64           `json:"ground_speed"`
+	Heading     float64           `json:"heading"`
+}
+
+// pointsQuery selects the fixes of the export: those from From to To, and
+// of those every Stride-th one. Local shows the times in the time zone of
+// the recorder rather than in UTC.
+type pointsQuery struct {
+	From, To time.Time
+	Stride   int
+	Local    bool
+}
+
+// Reads ?from=, ?to=, ?stride= and ?local=. Times are RFC 3339, or a time of day
+// during the flight, which starts at start: on its date, or the day after
+// for flights past midnight.
+func pointsFromQuery(query url.Values, start time.Time) (pointsQuery, error) {
+	q := pointsQuery{Stride: 1}
+	for _, p := range []struct {
+		name  string
+		value *time.Time
+	}{
+		{"from", &q.From},
+		{"to", &q.To},
+	} {
+		v := query.Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			clock, err := time.Parse("15:04:05", v)
+			if err != nil {
+				return q, fmt.Errorf("%s must be an RFC 3339 time or hh:mm:ss", p.name)
+			}
+			t = time.Date(start.Year(), start.Month(), start.Day(), clock.Hour(), clock.Minute(), clock.Second(), 0, time.UTC)
+			if start.Sub(t) > 12*time.Hour {
+				t = t.AddDate(0, 0, 1)
+			}
+		}
+		*p.value = t
+	}
+
+	if v := query.Get("local"); v != "" {
+		local, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, fmt.Errorf("local must be true or false")
+		}
+		q.Local = local
+	}
+
+	if v := query.Get("stride"); v != "" {
+		stride, err := strconv.Atoi(v)
+		if err != nil || stride < 1 {
+			return q, fmt.Errorf("stride must be a positive number of fixes")
+		}
+		q.Stride = stride
+	}
+	return q, nil
+}
+
+// Returns the fixes of the track selected by the query. The rates are
+// derived from the whole track, so they don't depend on the selection.
+func trackFixes(track igc.Track, q pointsQuery) []trackFix {
+	alt := altitudes(track.Points)
+	headings := fixHeadings(track.Points)
+
+	fixes := make([]trackFix, 0)
+	selected := 0
+	for i, p := range track.Points {
+		t := p.Time
+		if (!q.From.IsZero() && t.Before(q.From)) || (!q.To.IsZero() && t.After(q.To)) {
+			continue
+		}
+		selected++
+		if (selected-1)%q.Stride != 0 {
+			continue
+		}
+
+		if q.Local {
+			t = t.In(track.Location())
+		}
+		fix := trackFix{
+			Time:        t,
+			Lat:         round(p.Lat.Degrees(), 6),
+			Lng:         round(p.Lng.Degrees(), 6),
+			PressureAlt: p.PressureAltitude,
+			GNSSAlt:     p.GNSSAltitude,
+			Validity:    string(p.FixValidity),
+			Satellites:  p.NumSatellites,
+			Extensions:  make(map[string]string),
+			Heading:     round(headings[i], 1),
+		}
+		for code, v := range p.IData {
+			fix.Extensions[code] = strings.TrimSpace(v)
+		}
+		from, to := rateSpan(track.Points, i)
+		if seconds := track.Points[to].Time.Sub(track.Points[from].Time).Seconds(); seconds > 0 {
+			fix.Vario = round((alt[to]-alt[from])/seconds, 2)
+			fix.GroundSpeed = round(trackDistance(track.Points[from:to+1])/(seconds/3600), 2)
+		}
+		fixes = append(fixes, fix)
+	}
+	return fixes
+}
+
+// Returns the heading at every fix: the bearing to the next fix, kept
+// while the glider doesn't move
+func fixHeadings(points []igc.Point) []float64 {
+	headings := make([]float64, len(points))
+	heading := 0.0
+	for i := len(points) - 2; i >= 0; i-- {
+		if points[i].LatLng != points[i+1].LatLng {
+			heading = bearing(points[i].LatLng, points[i+1].LatLng)
+		}
+		headings[i] = heading
+	}
+	if n := len(points); n > 1 {
+		headings[n-1] = headings[n-2]
+	}
+	return headings
+}
+
+// Picks the offered content type the Accept header prefers, the first
+// offer if it has no preference, or "" if it accepts none of them
+func negotiate(accept string, offers ...string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		for _, offer := range offers {
+			matches := mediaType == offer || mediaType == "*/*" ||
+				(strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediaType, "*")))
+			if matches && q > bestQ {
+				best, bestQ = offer, q
+			}
+		}
+	}
+	return best
+}
+
+// Writes the fixes as CSV: a header row, then a row for every fix with a
+// column for every extension of the track
+func writeFixesCSV(w *csv.Writer, fixes []trackFix) error {
+	codes := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, f := range fixes {
+		for code := range f.Extensions {
+			if !seen[code] {
+				seen[code] = true
+				codes = append(codes, code)
+			}
+		}
+	}
+	sort.Strings(codes)
+
+	header := []string{"time", "lat", "lng", "pressure_alt", "gnss_alt", "validity", "satellites", "vario", "ground_speed", "heading"}
+	if err := w.Write(append(header, codes...)); err != nil {
+		return err
+	}
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	for _, f := range fixes {
+		row := []string{
+			f.Time.Format(time.RFC3339),
+			formatFloat(f.Lat),
+			formatFloat(f.Lng),
+			strconv.FormatInt(f.PressureAlt, 10),
+			strconv.FormatInt(f.GNSSAlt, 10),
+			f.Validity,
+			strconv.Itoa(f.Satellites),
+			formatFloat(f.Vario),
+			formatFloat(f.GroundSpeed),
+			formatFloat(f.Heading),
+		}
+		for _, code := range codes {
+			row = append(row, f.Extensions[code])
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// GET api/track/<id>/points exports every fix of the track, as JSON or
+// as CSV when the Accept header prefers text/csv. ?from= and ?to= limit
+// the export to a time window, ?stride=n keeps every n-th fix and
+// ?local=true gives the times in the time zone of the recorder.
+func (s *server) pointsHandler(w http.ResponseWriter, r *http.Request, fields igcFields) {
+	http.Header.Add(w.Header(), "vary", "accept")
+	contentType := negotiate(r.Header.Get("accept"), jsonContentType, csvContentType)
+	if contentType == "" {
+		writeError(w, http.StatusNotAcceptable, "not_acceptable",
+			fmt.Sprintf("points are served as %s or %s", jsonContentType, csvContentType))
+		return
+	}
+
+	track, ok := s.loadTrack(w, fields)
+	if !ok {
+		return
+	}
+	start := track.Date
+	if len(track.Points) > 0 {
+		start = track.Points[0].Time
+	}
+	q, err := pointsFromQuery(r.URL.Query(), start)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_query", err.Error())
+		return
+	}
+	fixes := trackFixes(track, q)
+
+	if contentType == csvContentType {
+		attachment(w, fields, csvContentType, "csv")
+		if err = writeFixesCSV(csv.NewWriter(w), fixes); err != nil {
+			log.Printf("could not send points of track %d: %v", fields.TrackID, err)
+		}
+		return
+	}
+
+	http.Header.Add(w.Header(), "content-type", jsonContentType)
+	if err = json.NewEncoder(w).Encode(&fixes); err != nil {
+		status := 500
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	cases := []struct {
+		accept   string
+		expected string
+	}{
+		{"", jsonContentType},
+		{"*/*", jsonContentType},
+		{"text/csv", csvContentType},
+		{"text/*", csvContentType},
+		{"application/json;q=0.5, text/csv", csvContentType},
+		{"text/csv;q=0.2, application/*;q=0.8", jsonContentType},
+		{"text/html, text/csv;q=0.1", csvContentType},
+		{"application/xml", ""},
+		{"text/csv;q=0", ""},
+	}
+	for _, c := range cases {
+		if got := negotiate(c.accept, jsonContentType, csvContentType); got != c.expected {
+			t.Errorf("Accept %q: expected %q, got %q", c.accept, c.expected, got)
+		}
+	}
+}
+
+// Gets the points of a track with the given Accept header
+func getPoints(t *testing.T, url string, accept string) *http.Response {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("accept", accept)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error creating the GET request, %s", err)
+	}
+	return resp
+}
+
+func TestTrackPoints(t *testing.T) {
+	srv := newTestServer()
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	id := uploadFlight(t, ts.URL, "testdata/flight.igc")
+	pointsURL := ts.URL + root + "/api/track/" + strconv.Itoa(id) + "/points"
+
+	fixes := make([]trackFix, 0)
+	getJSON(t, pointsURL, jsonContentType, &fixes)
+	if len(fixes) != 2206 {
+		t.Fatalf("Expected every fix, got %d", len(fixes))
+	}
+	first := fixes[0]
+	if !first.Time.Equal(time.Date(2018, 8, 16, 10, 0, 0, 0, time.UTC)) || first.Lat != 46.000017 || first.Lng != 8 ||
+		first.PressureAlt != 969 || first.GNSSAlt != 999 || first.Validity != "A" {
+		t.Errorf("Unexpected first fix %+v", first)
+	}
+
+	// gliding at 11 m/s on bearing 30
+	fixes = make([]trackFix, 0)
+	getJSON(t, pointsURL+"?from=10:20:00&to=2018-08-16T10:21:00Z&stride=5", jsonContentType, &fixes)
+	if len(fixes) != 7 {
+		t.Fatalf("Expected 7 fixes in the window, got %d", len(fixes))
+	}
+	for i, f := range fixes {
+		if expected := time.Date(2018, 8, 16, 10, 20, 10*i, 0, time.UTC); !f.Time.Equal(expected) {
+			t.Errorf("Expected fix %d at %s, got %s", i, expected, f.Time)
+		}
+		if math.Abs(f.GroundSpeed-39.6) > 0.5 || math.Abs(f.Heading-30) > 3 || f.Vario >= 0 {
+			t.Errorf("Unexpected rates at %s: %+v", f.Time, f)
+		}
+	}
+
+	resp := getPoints(t, pointsURL+"?stride=0", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid stride, got %d", resp.StatusCode)
+	}
+	resp = getPoints(t, pointsURL, "application/xml")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("Expected 406 for an unknown format, got %d", resp.StatusCode)
+	}
+
+	resp = getPoints(t, pointsURL, "text/csv")
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("content-type"); ct != csvContentType {
+		t.Errorf("Expected csv, got %s", ct)
+	}
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("Error reading csv, %s", err)
+	}
+	if len(rows) != 2207 || len(rows[0]) != 11 || rows[0][10] != "FXA" {
+		t.Fatalf("Expected a header and every fix, got %d rows", len(rows))
+	}
+	if rows[1][0] != "2018-08-16T10:00:00Z" || rows[1][4] != "999" {
+		t.Errorf("Unexpected first row %v", rows[1])
+	}
+}
+
+func TestTrackPointsExtensions(t *testing.T) {
+	srv := newTestServer()
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	// fix accuracy and satellites in use after every B record
+	file := filepath.Join(t.TempDir(), "extensions.igc")
+	content := "AXXX001\r\nHFDTE170818\r\nI023638FXA3940SIU\r\nF100000010203\r\n" +
+		"B1000004600000N00800000EA0100001000035 8\r\nB1000024600100N00800000EA0100201020012 9\r\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id := uploadFlight(t, ts.URL, file)
+	pointsURL := ts.URL + root + "/api/track/" + strconv.Itoa(id) + "/points"
+
+	fixes := make([]trackFix, 0)
+	getJSON(t, pointsURL, jsonContentType, &fixes)
+	if len(fixes) != 2 {
+		t.Fatalf("Expected 2 fixes, got %d", len(fixes))
+	}
+	if f := fixes[1]; f.Extensions["FXA"] != "012" || f.Extensions["SIU"] != "9" || f.Satellites != 3 || f.Vario != 1 {
+		t.Errorf("Unexpected fix %+v", f)
+	}
+
+	resp := getPoints(t, pointsURL, "text/csv")
+	defer resp.Body.Close()
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("Error reading csv, %s", err)
+	}
+	if len(rows) != 3 || len(rows[0]) != 12 || rows[0][10] != "FXA" || rows[1][10] != "035" || rows[1][11] != "8" {
+		t.Errorf("Expected a column for every extension, got %v", rows)
+	}
+}
+
+func TestTrackPointsMidnight(t *testing.T) {
+	srv := newTestServer()
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	// a flight past UTC midnight, recorded 2 hours ahead of UTC
+	file := filepath.Join(t.TempDir(), "midnight.igc")
+	content := "AXXX001\r\nHFDTEDATE:311218,01\r\nHFTZNTIMEZONE:2\r\n" +
+		"B2359584600000N00800000EA0100001000\r\nB0000004600100N00800000EA0100201020\r\n" +
+		"B0000024600200N00800000EA0100401040\r\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id := uploadFlight(t, ts.URL, file)
+	pointsURL := ts.URL + root + "/api/track/" + strconv.Itoa(id) + "/points"
+
+	fixes := make([]trackFix, 0)
+	getJSON(t, pointsURL+"?from=00:00:00", jsonContentType, &fixes)
+	if len(fixes) != 2 || !fixes[0].Time.Equal(time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Expected the fixes after midnight, got %v", fixes)
+	}
+	if fixes[0].Vario != 1 {
+		t.Errorf("Expected the climb across midnight, got %v", fixes[0].Vario)
+	}
+
+	resp := getPoints(t, pointsURL+"?local=true&stride=2", "text/csv")
+	defer resp.Body.Close()
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("Error reading csv, %s", err)
+	}
+	if len(rows) != 3 || rows[1][0] != "2019-01-01T01:59:58+02:00" || rows[2][0] != "2019-01-01T02:00:02+02:00" {
+		t.Errorf("Expected local times, got %v", rows)
+	}
+}
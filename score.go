@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/marni/goigc"
+	"gopkg.in/yaml.v2"
+)
+
+// ruleset scored when the request names none
+const defaultRuleset = "xcontest"
+
+// kinds of flight a ruleset scores
+const (
+	scoreFree = "free_distance"
+	scoreFlat = "flat_triangle"
+	scoreFAI  = "fai_triangle"
+)
+
+// ruleset is how a league scores a flight: every kind of flight is worth
+// its distance times a multiplier, and the flight scores as its best kind.
+// A multiplier of 0 leaves that kind out.
+type ruleset struct {
+	Name         string  `json:"name" yaml:"name"`
+	Description  string  `json:"description,omitempty" yaml:"description"`
+	FreeDistance float64 `json:"free_distance" yaml:"free_distance"`
+	FlatTriangle float64 `json:"flat_triangle" yaml:"flat_triangle"`
+	FAITriangle  float64 `json:"fai_triangle" yaml:"fai_triangle"`
+	Turnpoints   int     `json:"turnpoints" yaml:"turnpoints"` // of the free distance, up to 3
+	Closing      float64 `json:"closing" yaml:"closing"`       // largest start/finish gap, in percent of a triangle
+	SubtractGap  bool    `json:"subtract_gap" yaml:"subtract_gap"`
+}
+
+// the rulesets known without any file
+var builtinRulesets = []ruleset{
+	{
+		Name:         "xcontest",
+		Description:  "XContest: free flight, free triangle and FAI triangle",
+		FreeDistance: 1.0,
+		FlatTriangle: 1.2,
+		FAITriangle:  1.4,
+		Turnpoints:   3,
+		Closing:      20,
+		SubtractGap:  true,
+	},
+	{
+		Name:         "olc",
+		Description:  "OLC paragliding: free flight, flat triangle and FAI triangle",
+		FreeDistance: 1.5,
+		FlatTriangle: 1.75,
+		FAITriangle:  2.0,
+		Turnpoints:   3,
+		Closing:      20,
+		SubtractGap:  true,
+	},
+	{
+		Name:         "wxc",
+		Description:  "World XContest: closed triangles only count within 5%",
+		FreeDistance: 1.0,
+		FlatTriangle: 1.2,
+		FAITriangle:  1.4,
+		Turnpoints:   3,
+		Closing:      5,
+	},
+}
+
+// scoreCandidate is one kind of flight as scored by a ruleset
+type scoreCandidate struct {
+	Type       string  `json:"type"`
+	Distance   float64 `json:"distance"` // km
+	Multiplier float64 `json:"multiplier"`
+	Points     float64 `json:"points"`
+}
+
+// the response type for GET /paragliding/api/track/<id>/score
+type trackScore struct {
+	Ruleset    string           `json:"ruleset"`
+	Type       string           `json:"type"`
+	Points     float64          `json:"points"`
+	Candidates []scoreCandidate `json:"candidates"`
+}
+
+// Returns the rulesets by name: the built-in ones, and those of the .json,
+// .yaml and .yml files in dir, which replace built-in ones of the same
+// name. A missing dir only leaves the built-in rulesets.
+func loadRulesets(dir string) (map[string]ruleset, error) {
+	rulesets := make(map[string]ruleset)
+	for _, r := range builtinRulesets {
+		rulesets[r.Name] = r
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return rulesets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		ext := strings.ToLower(filepath.Ext(f.Name()))
+		if f.IsDir() || (ext != ".json" && ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		r, err := readRuleset(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name(), err)
+		}
+		rulesets[r.Name] = r
+	}
+	return rulesets, nil
+}
+
+// Reads a ruleset file, JSON or YAML depending on its extension.
+// The ruleset is named after the file unless it has a name.
+func readRuleset(file string) (ruleset, error) {
+	r := ruleset{Turnpoints: freeTurnpoints, Closing: triangleClosing}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return r, err
+	}
+
+	if strings.ToLower(filepath.Ext(file)) == ".json" {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&r)
+	} else {
+		err = yaml.UnmarshalStrict(content, &r)
+	}
+	if err != nil {
+		return r, err
+	}
+
+	if r.Name == "" {
+		r.Name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+	if r.Turnpoints < 0 || r.Turnpoints > 3 {
+		return r, fmt.Errorf("turnpoints must be between 0 and 3, got %d", r.Turnpoints)
+	}
+	return r, nil
+}
+
+// Scores the flights of the track under the ruleset
+func (r ruleset) score(track igc.Track, flights []flightSegment) trackScore {
+	result := trackScore{Ruleset: r.Name, Candidates: make([]scoreCandidate, 0)}
+	if len(flights) == 0 {
+		return result
+	}
+	track = airborneTrack(track, flights)
+
+	add := func(kind string, multiplier float64, optimizer igc.Optimizer, distance func(igc.Task) float64) {
+		if multiplier == 0 {
+			return
+		}
+		turnpoints := 3
+		if kind == scoreFree {
+			turnpoints = r.Turnpoints
+		}
+		task, err := optimizer.Optimize(track, turnpoints, distance)
+		if err != nil {
+			log.Printf("could not score the %s: %v", kind, err)
+			return
+		}
+
+		c := scoreCandidate{Type: kind, Distance: distance(task), Multiplier: multiplier}
+		if kind != scoreFree && c.Distance > 0 && r.SubtractGap {
+			c.Distance -= task.Start.Distance(task.Finish)
+		}
+		c.Points = c.Distance * multiplier
+		result.Candidates = append(result.Candidates, c)
+	}
+	add(scoreFree, r.FreeDistance, freeDistanceOptimizer, igc.Distance)
+	add(scoreFlat, r.FlatTriangle, igc.NewTriangleOptimizer(false, r.Closing), igc.TriangleDistance)
+	add(scoreFAI, r.FAITriangle, igc.NewTriangleOptimizer(true, r.Closing), igc.TriangleDistance)
+
+	sort.SliceStable(result.Candidates, func(i, j int) bool {
+		return result.Candidates[i].Points > result.Candidates[j].Points
+	})
+	if len(result.Candidates) > 0 {
+		result.Type = result.Candidates[0].Type
+		result.Points = result.Candidates[0].Points
+	}
+	return result
+}
+
+// GET api/track/<id>/score scores the track under ?ruleset=, by default
+// defaultRuleset
+func (s *server) scoreHandler(w http.ResponseWriter, r *http.Request, fields igcFields) {
+	name := r.URL.Query().Get("ruleset")
+	if name == "" {
+		name = defaultRuleset
+	}
+	rules, ok := s.rulesets[name]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "unknown_ruleset", fmt.Sprintf("no ruleset %q", name))
+		return
+	}
+
+	track, ok := s.loadTrack(w, fields)
+	if !ok {
+		return
+	}
+	result := rules.score(track, airborneSegments(track.Points))
+
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(&result); err != nil {
+		status := 500
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+}
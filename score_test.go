@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestLoadRulesets(t *testing.T) {
+	rulesets, err := loadRulesets("rulesets")
+	if err != nil {
+		t.Fatalf("Error loading rulesets, %s", err)
+	}
+	for _, name := range []string{"xcontest", "olc", "wxc", "cfd", "dhv"} {
+		if _, ok := rulesets[name]; !ok {
+			t.Errorf("Expected ruleset %s", name)
+		}
+	}
+
+	// from the YAML file
+	dhv := rulesets["dhv"]
+	if dhv.FreeDistance != 1.5 || dhv.FAITriangle != 2 || dhv.Closing != 20 || !dhv.SubtractGap || dhv.Turnpoints != 3 {
+		t.Errorf("Unexpected dhv ruleset %+v", dhv)
+	}
+	if dhv.Description != "DHV-XC: free flight, flat triangle and FAI triangle" {
+		t.Errorf("Unexpected dhv description %q", dhv.Description)
+	}
+
+	rulesets, err = loadRulesets("does-not-exist")
+	if err != nil || len(rulesets) != len(builtinRulesets) {
+		t.Errorf("Expected the built-in rulesets without a directory, got %d, %v", len(rulesets), err)
+	}
+}
+
+func TestReadRuleset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rulesets")
+	if err != nil {
+		t.Fatalf("Error creating directory, %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("Error writing %s, %s", name, err)
+		}
+		return file
+	}
+
+	// named after the file, with the default turnpoints and closing
+	r, err := readRuleset(write("league.yml", "---\nfai_triangle: 3 # only triangles\n'flat_triangle': 0\n"))
+	if err != nil {
+		t.Fatalf("Error reading ruleset, %s", err)
+	}
+	if r.Name != "league" || r.FAITriangle != 3 || r.FreeDistance != 0 || r.Turnpoints != freeTurnpoints || r.Closing != triangleClosing {
+		t.Errorf("Unexpected ruleset %+v", r)
+	}
+
+	for name, content := range map[string]string{
+		"unknown.json":    `{"fai_triangles": 2}`,
+		"turnpoints.json": `{"turnpoints": 5}`,
+		"syntax.yaml":     "free_distance 1.0\n",
+		"type.yaml":       "free_distance: yes please\n",
+		"unknown.yaml":    "fai_triangles: 2\n",
+	} {
+		if _, err := readRuleset(write(name, content)); err == nil {
+			t.Errorf("Expected an error reading %s", name)
+		}
+	}
+}
+
+func TestRulesetScore(t *testing.T) {
+	track := parseTestFlight(t, "testdata/flight.igc")
+	flights := airborneSegments(track.Points)
+	rulesets, _ := loadRulesets("rulesets")
+
+	// the flight closes an FAI triangle of about 32km within 5%
+	xcontest := rulesets["xcontest"].score(track, flights)
+	if xcontest.Type != scoreFAI || len(xcontest.Candidates) != 3 {
+		t.Fatalf("Expected the FAI triangle to score best, got %+v", xcontest)
+	}
+	best := xcontest.Candidates[0]
+	if best.Multiplier != 1.4 || math.Abs(best.Points-best.Distance*1.4) > 1e-9 || xcontest.Points != best.Points {
+		t.Errorf("Unexpected FAI triangle score %+v", best)
+	}
+	if best.Distance < 30 || best.Distance > 34 {
+		t.Errorf("Expected about 32km, got %.2f", best.Distance)
+	}
+
+	// wxc doesn't take the gap off
+	if wxc := rulesets["wxc"].score(track, flights); wxc.Candidates[0].Distance <= best.Distance {
+		t.Errorf("Expected a longer triangle without the gap, got %.2f", wxc.Candidates[0].Distance)
+	}
+
+	free := ruleset{Name: "free", FreeDistance: 1, Turnpoints: 1}
+	result := free.score(track, flights)
+	if result.Type != scoreFree || len(result.Candidates) != 1 {
+		t.Errorf("Expected only the free distance, got %+v", result)
+	}
+	if result.Points > xcontest.Candidates[2].Points {
+		t.Errorf("Expected less with one turnpoint than with three, got %.2f", result.Points)
+	}
+}
+
+func TestTrackScore(t *testing.T) {
+	srv := newTestServer()
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	id := uploadFlight(t, ts.URL, "testdata/flight.igc")
+	scoreURL := ts.URL + root + "/api/track/" + strconv.Itoa(id) + "/score"
+
+	points := make(map[string]float64)
+	for _, name := range []string{"", "olc", "dhv"} {
+		resp, err := http.Get(scoreURL + "?ruleset=" + name)
+		if err != nil {
+			t.Fatalf("Error creating the GET request, %s", err)
+		}
+		result := trackScore{}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Error decoding score, %s", err)
+		}
+		if name == "" && result.Ruleset != defaultRuleset {
+			t.Errorf("Expected the %s ruleset by default, got %s", defaultRuleset, result.Ruleset)
+		}
+		if result.Type != scoreFAI || result.Points <= 0 {
+			t.Errorf("%s: expected an FAI triangle score, got %+v", name, result)
+		}
+		points[result.Ruleset] = result.Points
+	}
+	if points["olc"] <= points[defaultRuleset] {
+		t.Errorf("Expected more points with olc than %s, got %v", defaultRuleset, points)
+	}
+
+	resp, err := http.Get(scoreURL + "?ruleset=unknown")
+	if err != nil {
+		t.Fatalf("Error creating the GET request, %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown ruleset, got %d", resp.StatusCode)
+	}
+}
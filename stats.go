@@ -0,0 +1,170 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+// time span used for vertical and ground speed, so a single noisy fix
+// doesn't make a record climb or speed
+const rateWindow = 10 * time.Second
+
+// number of fixes averaged when summing the altitude gain
+const gainSmoothing = 5
+
+// flightStats holds the statistics computed from the airborne fixes of a
+// track. Altitudes are in metres, rates in m/s and speeds in km/h.
+type flightStats struct {
+	TakeoffTime  time.Time `bson:"takeoff_time" json:"takeoff_time"`
+	LandingTime  time.Time `bson:"landing_time" json:"landing_time"`
+	Duration     int       `bson:"duration" json:"duration"` // seconds
+	MaxPressAlt  int64     `bson:"max_pressure_alt" json:"max_pressure_alt"`
+	MinPressAlt  int64     `bson:"min_pressure_alt" json:"min_pressure_alt"`
+	MaxGNSSAlt   int64     `bson:"max_gnss_alt" json:"max_gnss_alt"`
+	MinGNSSAlt   int64     `bson:"min_gnss_alt" json:"min_gnss_alt"`
+	AltitudeGain float64   `bson:"altitude_gain" json:"altitude_gain"`
+	MaxClimb     float64   `bson:"max_climb" json:"max_climb"`
+	MaxSink      float64   `bson:"max_sink" json:"max_sink"`
+	AvgSpeed     float64   `bson:"avg_speed" json:"avg_speed"`
+	MaxSpeed     float64   `bson:"max_speed" json:"max_speed"`
+	Fixes        int       `bson:"fixes" json:"fixes"`
+	Flights      int       `bson:"flights" json:"flights"`
+
+	// share of the airborne time spent in thermals, in percent, and the
+	// average climb rate in them
+	CirclingPercent float64 `bson:"circling_percent" json:"circling_percent"`
+	AvgClimb        float64 `bson:"avg_climb" json:"avg_climb"`
+
+	// glide ratio over all glides, and the best one held for sustainedGlide
+	GlideRatio float64 `bson:"glide_ratio" json:"glide_ratio"`
+	BestGlide  float64 `bson:"best_glide" json:"best_glide"`
+}
+
+// Computes the statistics of the airborne segments of the fixes, whose
+// times are in UTC and run on past midnight. Ground fixes before, between
+// and after the flights are ignored.
+func computeStats(points []igc.Point, flights []flightSegment) flightStats {
+	stats := flightStats{Flights: len(flights)}
+	if len(flights) == 0 {
+		return stats
+	}
+
+	first, last := points[flights[0].Takeoff], points[flights[len(flights)-1].Landing]
+	stats.TakeoffTime = first.Time
+	stats.LandingTime = last.Time
+	stats.MaxPressAlt, stats.MinPressAlt = first.PressureAltitude, first.PressureAltitude
+	stats.MaxGNSSAlt, stats.MinGNSSAlt = first.GNSSAltitude, first.GNSSAltitude
+
+	distance := 0.0
+	for _, f := range flights {
+		flight := points[f.Takeoff : f.Landing+1]
+		stats.Fixes += len(flight)
+		stats.Duration += int(flight[len(flight)-1].Time.Sub(flight[0].Time) / time.Second)
+		distance += trackDistance(flight)
+
+		for _, p := range flight {
+			stats.MaxPressAlt = maxInt64(stats.MaxPressAlt, p.PressureAltitude)
+			stats.MinPressAlt = minInt64(stats.MinPressAlt, p.PressureAltitude)
+			stats.MaxGNSSAlt = maxInt64(stats.MaxGNSSAlt, p.GNSSAltitude)
+			stats.MinGNSSAlt = minInt64(stats.MinGNSSAlt, p.GNSSAltitude)
+		}
+
+		alt := altitudes(flight)
+		stats.AltitudeGain += altitudeGain(alt)
+
+		// rates over rateWindow, from each fix to the first fix at least
+		// rateWindow later
+		j := 0
+		for i := range flight {
+			for j < len(flight) && flight[j].Time.Sub(flight[i].Time) < rateWindow {
+				j++
+			}
+			if j == len(flight) {
+				break
+			}
+			seconds := flight[j].Time.Sub(flight[i].Time).Seconds()
+
+			vario := (alt[j] - alt[i]) / seconds
+			stats.MaxClimb = math.Max(stats.MaxClimb, vario)
+			stats.MaxSink = math.Min(stats.MaxSink, vario)
+
+			stats.MaxSpeed = math.Max(stats.MaxSpeed, trackDistance(flight[i:j+1])/(seconds/3600))
+		}
+	}
+
+	if stats.Duration > 0 {
+		stats.AvgSpeed = distance / (float64(stats.Duration) / 3600)
+	}
+	return stats
+}
+
+// Sums the distances between consecutive fixes, in km
+func trackDistance(points []igc.Point) float64 {
+	distance := 0.0
+	for i := 0; i < len(points)-1; i++ {
+		distance += points[i].Distance(points[i+1])
+	}
+	return distance
+}
+
+// Returns the altitude of every fix, in metres. Pressure altitude is used
+// when the recorder has a pressure sensor, GNSS altitude otherwise.
+func altitudes(points []igc.Point) []float64 {
+	pressure := false
+	for _, p := range points {
+		if p.PressureAltitude != 0 {
+			pressure = true
+			break
+		}
+	}
+
+	alt := make([]float64, len(points))
+	for i, p := range points {
+		if pressure {
+			alt[i] = float64(p.PressureAltitude)
+		} else {
+			alt[i] = float64(p.GNSSAltitude)
+		}
+	}
+	return alt
+}
+
+// Sums the climbs of the altitude profile, on a moving average so
+// sensor noise isn't counted as gain
+func altitudeGain(alt []float64) float64 {
+	gain := 0.0
+	previous := 0.0
+	for i := range alt {
+		from := i - gainSmoothing + 1
+		if from < 0 {
+			from = 0
+		}
+		sum := 0.0
+		for _, a := range alt[from : i+1] {
+			sum += a
+		}
+		smooth := sum / float64(i+1-from)
+
+		if i > 0 && smooth > previous {
+			gain += smooth - previous
+		}
+		previous = smooth
+	}
+	return gain
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+// Parses an IGC file of testdata
+func parseTestFlight(t *testing.T, file string) igc.Track {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Error reading %s, %s", file, err)
+	}
+	track, err := igc.Parse(string(content))
+	if err != nil {
+		t.Fatalf("Error parsing %s, %s", file, err)
+	}
+	return track
+}
+
+func TestComputeStats(t *testing.T) {
+	track := parseTestFlight(t, "testdata/flight.igc")
+	stats := computeStats(track.Points, airborneSegments(track.Points))
+
+	// the flight leaves the ground at 10:03:00 and lands at 11:10:30,
+	// between the walk to launch and the packing up
+	if stats.Flights != 1 {
+		t.Errorf("Expected 1 flight, got %d", stats.Flights)
+	}
+	if want := time.Date(2018, 8, 16, 10, 3, 0, 0, time.UTC); !closeInTime(stats.TakeoffTime, want, 10*time.Second) {
+		t.Errorf("Expected takeoff at %v, got %v", want, stats.TakeoffTime)
+	}
+	if want := time.Date(2018, 8, 16, 11, 10, 30, 0, time.UTC); !closeInTime(stats.LandingTime, want, 10*time.Second) {
+		t.Errorf("Expected landing at %v, got %v", want, stats.LandingTime)
+	}
+	if stats.Duration < 4030 || stats.Duration > 4070 {
+		t.Errorf("Expected about 4050 seconds, got %d", stats.Duration)
+	}
+	if stats.Fixes < 2015 || stats.Fixes > 2035 {
+		t.Errorf("Expected about 2025 airborne fixes, got %d", stats.Fixes)
+	}
+	if stats.MaxGNSSAlt < 2200 || stats.MaxGNSSAlt > 2240 || stats.MinGNSSAlt < 590 || stats.MinGNSSAlt > 610 {
+		t.Errorf("Unexpected GNSS altitude range %d-%d", stats.MinGNSSAlt, stats.MaxGNSSAlt)
+	}
+	if stats.MaxPressAlt != stats.MaxGNSSAlt-30 && stats.MaxPressAlt != stats.MaxGNSSAlt-31 && stats.MaxPressAlt != stats.MaxGNSSAlt-29 {
+		t.Errorf("Expected pressure altitude 30m below GNSS, got %d and %d", stats.MaxPressAlt, stats.MaxGNSSAlt)
+	}
+	// three thermals: 1200 + 1080 + 450 m
+	if stats.AltitudeGain < 2650 || stats.AltitudeGain > 2850 {
+		t.Errorf("Expected about 2730m of gain, got %.0f", stats.AltitudeGain)
+	}
+	if stats.MaxClimb < 2.3 || stats.MaxClimb > 2.8 {
+		t.Errorf("Expected max climb about 2.5m/s, got %.2f", stats.MaxClimb)
+	}
+	if stats.MaxSink > -1.0 || stats.MaxSink < -1.5 {
+		t.Errorf("Expected max sink about -1.1m/s, got %.2f", stats.MaxSink)
+	}
+	// glides at 40km/h, circling in the wind a bit faster
+	if stats.MaxSpeed < 38 || stats.MaxSpeed > 48 {
+		t.Errorf("Expected max speed about 40-45km/h, got %.1f", stats.MaxSpeed)
+	}
+	if stats.AvgSpeed <= 0 || stats.AvgSpeed > stats.MaxSpeed {
+		t.Errorf("Unexpected average speed %.1f", stats.AvgSpeed)
+	}
+}
+
+func closeInTime(a, b time.Time, tolerance time.Duration) bool {
+	d := a.Sub(b)
+	return d <= tolerance && d >= -tolerance
+}
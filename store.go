@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errTrackNotFound is returned by a TrackStore when no track matches the query
+var errTrackNotFound = errors.New("track not found")
+
+// errIGCNotFound is returned by OpenIGC when no file is stored for a track
+var errIGCNotFound = errors.New("igc file not found")
+
+// errJobNotFound is returned by GetJob for unknown job IDs
+var errJobNotFound = errors.New("job not found")
+
+// errDuplicateTrackID is returned by Insert when the track ID is already taken
+var errDuplicateTrackID = errors.New("duplicate track id")
+
+// errDuplicateFlight is returned by Insert when a track with the same
+// content hash or flight fingerprint is already stored
+var errDuplicateFlight = errors.New("duplicate flight")
+
+// TrackStore is the persistence layer used by the handlers.
+// Implementations must be safe for concurrent use.
+type TrackStore interface {
+	// NextID atomically allocates a track ID. IDs are never handed out twice,
+	// even after tracks are deleted.
+	NextID() (int, error)
+	// Insert adds a new track. The check for a stored track with the same
+	// hash or fingerprint is atomic with the insert.
+	Insert(fields igcFields) error
+	// Get returns the track with the given track ID
+	Get(id int) (igcFields, error)
+	// Latest returns the most recently added track
+	Latest() (igcFields, error)
+	// FindDuplicate returns a track with the given content hash or flight
+	// fingerprint, or errTrackNotFound
+	FindDuplicate(hash, fingerprint string) (igcFields, error)
+	// List returns every track in insertion order
+	List() ([]igcFields, error)
+	// Count returns the number of stored tracks
+	Count() (int, error)
+	// DeleteAll removes every track and its IGC file
+	DeleteAll() error
+	// PutIGC stores the original IGC file of a track under the track ID
+	PutIGC(id int, name string, content []byte) error
+	// DeleteIGC removes the original IGC file of a track
+	DeleteIGC(id int) error
+	// OpenIGC returns the original IGC file of a track and its file name.
+	// The caller must close the reader.
+	OpenIGC(id int) (io.ReadCloser, string, error)
+	// InsertJob adds a new ingestion job
+	InsertJob(j job) error
+	// UpdateJob replaces the stored job with the same ID
+	UpdateJob(j job) error
+	// GetJob returns the job with the given ID
+	GetJob(id string) (job, error)
+	// PendingJobs returns the queued and running jobs, oldest first
+	PendingJobs() ([]job, error)
+	// Range returns up to limit tracks with from < timestamp <= to, oldest first.
+	// A zero to means no upper bound.
+	Range(from, to time.Time, limit int) ([]igcFields, error)
+}
+
+// memoryStore keeps tracks in process memory. Nothing survives a restart,
+// which makes it useful for tests and local development.
+type memoryStore struct {
+	mu     sync.RWMutex
+	tracks []igcFields
+	files  map[int]igcFile
+	jobs   map[string]job
+	nextID int
+}
+
+// an original IGC file kept by the memoryStore
+type igcFile struct {
+	name    string
+	content []byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{files: make(map[int]igcFile), jobs: make(map[string]job)}
+}
+
+func (m *memoryStore) NextID() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := m.nextID
+	m.nextID++
+	return id, nil
+}
+
+func (m *memoryStore) Insert(fields igcFields) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, t := range m.tracks {
+		if t.TrackID == fields.TrackID {
+			return errDuplicateTrackID
+		}
+		if (fields.Hash != "" && t.Hash == fields.Hash) || (fields.Fingerprint != "" && t.Fingerprint == fields.Fingerprint) {
+			return errDuplicateFlight
+		}
+	}
+	m.tracks = append(m.tracks, fields)
+	return nil
+}
+
+func (m *memoryStore) Get(id int) (igcFields, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, t := range m.tracks {
+		if t.TrackID == id {
+			return t, nil
+		}
+	}
+	return igcFields{}, errTrackNotFound
+}
+
+func (m *memoryStore) Latest() (igcFields, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	latest := igcFields{}
+	if len(m.tracks) == 0 {
+		return latest, errTrackNotFound
+	}
+	for _, t := range m.tracks {
+		if !t.Timestamp.Before(latest.Timestamp) {
+			latest = t
+		}
+	}
+	return latest, nil
+}
+
+func (m *memoryStore) FindDuplicate(hash, fingerprint string) (igcFields, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, t := range m.tracks {
+		if (hash != "" && t.Hash == hash) || (fingerprint != "" && t.Fingerprint == fingerprint) {
+			return t, nil
+		}
+	}
+	return igcFields{}, errTrackNotFound
+}
+
+func (m *memoryStore) List() ([]igcFields, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := make([]igcFields, len(m.tracks))
+	copy(list, m.tracks)
+	return list, nil
+}
+
+func (m *memoryStore) Count() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.tracks), nil
+}
+
+func (m *memoryStore) DeleteAll() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tracks = nil
+	m.files = make(map[int]igcFile)
+	return nil
+}
+
+func (m *memoryStore) PutIGC(id int, name string, content []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[id]; ok {
+		return errDuplicateTrackID
+	}
+	m.files[id] = igcFile{name: name, content: content}
+	return nil
+}
+
+func (m *memoryStore) DeleteIGC(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.files, id)
+	return nil
+}
+
+func (m *memoryStore) OpenIGC(id int) (io.ReadCloser, string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	file, ok := m.files[id]
+	if !ok {
+		return nil, "", errIGCNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(file.content)), file.name, nil
+}
+
+func (m *memoryStore) Range(from, to time.Time, limit int) ([]igcFields, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	items := make([]igcFields, 0)
+	for _, t := range m.tracks {
+		if !t.Timestamp.After(from) {
+			continue
+		}
+		if !to.IsZero() && t.Timestamp.After(to) {
+			continue
+		}
+		items = append(items, t)
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Timestamp.Before(items[j].Timestamp)
+	})
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	return items, nil
+}
+
+func (m *memoryStore) InsertJob(j job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.jobs[j.ID] = j
+	return nil
+}
+
+func (m *memoryStore) UpdateJob(j job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.jobs[j.ID]; !ok {
+		return errJobNotFound
+	}
+	m.jobs[j.ID] = j
+	return nil
+}
+
+func (m *memoryStore) GetJob(id string) (job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	j, ok := m.jobs[id]
+	if !ok {
+		return job{}, errJobNotFound
+	}
+	return j, nil
+}
+
+func (m *memoryStore) PendingJobs() ([]job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	pending := make([]job, 0)
+	for _, j := range m.jobs {
+		if j.Status == jobQueued || j.Status == jobRunning {
+			pending = append(pending, j)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Created.Before(pending[j].Created)
+	})
+	return pending, nil
+}
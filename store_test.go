@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := newMemoryStore()
+	base := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		err := store.Insert(igcFields{TrackID: i, Pilot: "pilot", Timestamp: base.Add(time.Duration(i) * time.Minute)})
+		if err != nil {
+			t.Fatalf("Error inserting track %d, %s", i, err)
+		}
+	}
+
+	if n, _ := store.Count(); n != 3 {
+		t.Errorf("Expected 3 tracks, got %d", n)
+	}
+
+	if track, err := store.Get(1); err != nil || !track.Timestamp.Equal(base.Add(time.Minute)) {
+		t.Errorf("Expected track 1, got %v (%v)", track, err)
+	}
+
+	if _, err := store.Get(42); err != errTrackNotFound {
+		t.Errorf("Expected errTrackNotFound, got %v", err)
+	}
+
+	items, _ := store.Range(base, time.Time{}, 5)
+	if len(items) != 2 || items[0].TrackID != 1 {
+		t.Errorf("Expected tracks 1 and 2 after %v, got %v", base, items)
+	}
+
+	items, _ = store.Range(time.Time{}, base.Add(time.Minute), 1)
+	if len(items) != 1 || items[0].TrackID != 0 {
+		t.Errorf("Expected only track 0, got %v", items)
+	}
+
+	if err := store.DeleteAll(); err != nil {
+		t.Fatalf("Error deleting tracks, %s", err)
+	}
+	if n, _ := store.Count(); n != 0 {
+		t.Errorf("Expected empty store, got %d tracks", n)
+	}
+}
+
+func TestMemoryStoreNextID(t *testing.T) {
+	store := newMemoryStore()
+
+	ids := make(chan int, 50)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(ids); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, _ := store.NextID()
+			ids <- id
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[int]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("ID %d allocated twice", id)
+		}
+		seen[id] = true
+	}
+
+	_ = store.Insert(igcFields{TrackID: 7})
+	if err := store.Insert(igcFields{TrackID: 7}); err != errDuplicateTrackID {
+		t.Errorf("Expected errDuplicateTrackID, got %v", err)
+	}
+
+	_ = store.Insert(igcFields{TrackID: 8, Hash: "hash", Fingerprint: "fingerprint"})
+	for _, f := range []igcFields{{TrackID: 9, Hash: "hash"}, {TrackID: 10, Fingerprint: "fingerprint"}} {
+		if err := store.Insert(f); err != errDuplicateFlight {
+			t.Errorf("Expected errDuplicateFlight for %+v, got %v", f, err)
+		}
+	}
+
+	// IDs are not reused after a delete
+	_ = store.DeleteAll()
+	if id, _ := store.NextID(); id != cap(ids) {
+		t.Errorf("Expected ID %d after delete, got %d", cap(ids), id)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/geo/s2"
+	"github.com/marni/goigc"
+)
+
+// shapes of the observation zones of a task
+const (
+	zoneCylinder = "cylinder" // within radius of the point
+	zoneSector   = "sector"   // FAI sector: 90 degrees facing away from the course
+	zoneLine     = "line"     // crossing a line through the point, across the course
+)
+
+// observation zones used when the request doesn't set them
+var defaultZones = taskZones{
+	Turnpoint:  zoneCylinder,
+	Start:      zoneCylinder,
+	Finish:     zoneCylinder,
+	Radius:     400,
+	LineLength: 1000,
+}
+
+// taskZones configures the observation zones of a task. Distances are in
+// metres.
+type taskZones struct {
+	Turnpoint  string
+	Start      string
+	Finish     string
+	Radius     float64 // of the cylinders
+	LineLength float64
+}
+
+// taskPoint is a point of a declared task and when the flight reached it
+type taskPoint struct {
+	Name    string     `json:"name"`
+	Lat     float64    `json:"lat"`
+	Lng     float64    `json:"lng"`
+	Zone    string     `json:"zone"`
+	Reached bool       `json:"reached"`
+	Time    *time.Time `json:"time,omitempty"`
+
+	point igc.Point
+	// for sectors, the bearings to the points before and after
+	inbound, outbound float64
+	// for lines, the bearing of the leg through the point
+	course float64
+}
+
+// the response type for GET /paragliding/api/track/<id>/task
+type taskResult struct {
+	Completed bool        `json:"completed"`
+	Distance  float64     `json:"distance"` // km, through the declared points
+	Duration  int         `json:"duration,omitempty"`
+	Speed     float64     `json:"speed,omitempty"` // km/h, from start to finish
+	Points    []taskPoint `json:"points"`
+	Missed    []string    `json:"missed"`
+}
+
+// Reads the observation zones from the ?zone=, ?start=, ?finish=, ?radius=
+// and ?line_length= parameters
+func zonesFromQuery(query url.Values) (taskZones, error) {
+	zones := defaultZones
+	for _, p := range []struct {
+		name   string
+		value  *string
+		shapes []string
+	}{
+		{"zone", &zones.Turnpoint, []string{zoneCylinder, zoneSector}},
+		{"start", &zones.Start, []string{zoneCylinder, zoneLine}},
+		{"finish", &zones.Finish, []string{zoneCylinder, zoneLine}},
+	} {
+		v := query.Get(p.name)
+		if v == "" {
+			continue
+		}
+		valid := false
+		for _, shape := range p.shapes {
+			valid = valid || v == shape
+		}
+		if !valid {
+			return zones, fmt.Errorf("%s must be one of %v", p.name, p.shapes)
+		}
+		*p.value = v
+	}
+
+	for _, p := range []struct {
+		name  string
+		value *float64
+	}{
+		{"radius", &zones.Radius},
+		{"line_length", &zones.LineLength},
+	} {
+		v := query.Get(p.name)
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 {
+			return zones, fmt.Errorf("%s must be a positive number of metres", p.name)
+		}
+		*p.value = f
+	}
+	return zones, nil
+}
+
+// Returns the start, turnpoints and finish of the declared task, or none
+// if the track has no task. A task may go from start to finish without
+// turnpoints.
+func declaredTask(task igc.Task, zones taskZones) []taskPoint {
+	set := func(p igc.Point) bool {
+		return p.Lat != 0 || p.Lng != 0 || p.Description != ""
+	}
+	if len(task.Turnpoints) == 0 && (!set(task.Start) || !set(task.Finish)) {
+		return nil
+	}
+	points := []igc.Point{task.Start}
+	points = append(points, task.Turnpoints...)
+	points = append(points, task.Finish)
+
+	declared := make([]taskPoint, len(points))
+	for i, p := range points {
+		tp := taskPoint{
+			Name:  strings.TrimSpace(p.Description),
+			Lat:   p.Lat.Degrees(),
+			Lng:   p.Lng.Degrees(),
+			Zone:  zones.Turnpoint,
+			point: p,
+		}
+		switch i {
+		case 0:
+			tp.Zone = zones.Start
+		case len(points) - 1:
+			tp.Zone = zones.Finish
+		}
+		if i > 0 {
+			tp.inbound = bearing(p.LatLng, points[i-1].LatLng)
+			tp.course = math.Mod(tp.inbound+180, 360)
+		}
+		if i < len(points)-1 {
+			tp.outbound = bearing(p.LatLng, points[i+1].LatLng)
+			tp.course = tp.outbound
+		}
+		declared[i] = tp
+	}
+	return declared
+}
+
+// Checks that the fixes reach the task points in order. The flight starts
+// with its last start before the first turnpoint. A turnpoint that is not
+// reached is missed, and the following ones are looked for from the last
+// point reached, once the flight left it if they are at the same place,
+// like the start and finish of an out-and-return.
+func verifyTask(points []igc.Point, task []taskPoint, zones taskZones) taskResult {
+	result := taskResult{Points: task, Missed: make([]string, 0)}
+	for i := 1; i < len(task); i++ {
+		result.Distance += task[i-1].point.Distance(task[i].point)
+	}
+
+	reached := func(tp taskPoint, i int) bool {
+		switch tp.Zone {
+		case zoneLine:
+			return i > 0 && crossesLine(points[i-1].LatLng, points[i].LatLng, tp, zones.LineLength)
+		case zoneSector:
+			return inSector(points[i].LatLng, tp)
+		default:
+			return tp.point.Distance(points[i])*1000 <= zones.Radius
+		}
+	}
+	mark := func(k int, i int) {
+		t := points[i].Time
+		task[k].Reached, task[k].Time = true, &t
+	}
+
+	from, start := 0, -1
+	for k := range task {
+		if k > 0 && task[k].point.LatLng == task[k-1].point.LatLng {
+			for from < len(points) && reached(task[k-1], from) {
+				from++
+			}
+		}
+		found := -1
+		for i := from; i < len(points); i++ {
+			if reached(task[k], i) {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			result.Missed = append(result.Missed, task[k].Name)
+			continue
+		}
+		if k == 1 && start >= 0 {
+			// restarts before the first turnpoint replace the start
+			for i := start + 1; i < found; i++ {
+				if reached(task[0], i) {
+					start = i
+				}
+			}
+			mark(0, start)
+		}
+		if k == 0 {
+			start = found
+		}
+		mark(k, found)
+		from = found
+	}
+
+	result.Completed = len(result.Missed) == 0
+	if result.Completed {
+		finish := task[len(task)-1].Time
+		result.Duration = int(finish.Sub(*task[0].Time) / time.Second)
+		if result.Duration > 0 {
+			result.Speed = result.Distance / (float64(result.Duration) / 3600)
+		}
+	}
+	return result
+}
+
+// Reports whether the point is in the FAI sector of the turnpoint: the
+// quadrant centred on the bisector of the legs, facing away from them
+func inSector(p s2.LatLng, tp taskPoint) bool {
+	if p == tp.point.LatLng {
+		return true
+	}
+	bisector := tp.inbound + headingChange(tp.inbound, tp.outbound)/2
+	return math.Abs(headingChange(bisector+180, bearing(tp.point.LatLng, p))) <= 45
+}
+
+// Reports whether the flight from a to b crosses the line of the task
+// point: lineLength metres long, centred on the point and square to the
+// course, flown in the direction of the course
+func crossesLine(a, b s2.LatLng, tp taskPoint, lineLength float64) bool {
+	// flat projection in metres around the task point, x east and y north,
+	// good enough over a line a few km long
+	project := func(p s2.LatLng) (float64, float64) {
+		x := (p.Lng - tp.point.Lng).Radians() * math.Cos(tp.point.Lat.Radians()) * igc.EarthRadius * 1000
+		y := (p.Lat - tp.point.Lat).Radians() * igc.EarthRadius * 1000
+		return x, y
+	}
+	ax, ay := project(a)
+	bx, by := project(b)
+
+	// distances ahead of the line, along the course: from behind it to
+	// ahead of it, crossing back does not count
+	c := tp.course * math.Pi / 180
+	da := ax*math.Sin(c) + ay*math.Cos(c)
+	db := bx*math.Sin(c) + by*math.Cos(c)
+	if da >= 0 || db < 0 {
+		return false
+	}
+
+	// where the flight crosses, along the line
+	f := da / (da - db)
+	x, y := ax+f*(bx-ax), ay+f*(by-ay)
+	return math.Abs(x*math.Cos(c)-y*math.Sin(c)) <= lineLength/2
+}
+
+// GET api/track/<id>/task checks the declared task of the track was flown
+func (s *server) taskHandler(w http.ResponseWriter, r *http.Request, fields igcFields) {
+	zones, err := zonesFromQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_zone", err.Error())
+		return
+	}
+
+	track, ok := s.loadTrack(w, fields)
+	if !ok {
+		return
+	}
+	task := declaredTask(track.Task, zones)
+	if task == nil {
+		writeError(w, http.StatusNotFound, "no_task", "the track has no declared task")
+		return
+	}
+
+	flights := airborneSegments(track.Points)
+	result := verifyTask(airborneTrack(track, flights).Points, task, zones)
+
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	if err = json.NewEncoder(w).Encode(&result); err != nil {
+		status := 500
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+}
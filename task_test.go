@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+func TestVerifyTask(t *testing.T) {
+	track := parseTestFlight(t, "testdata/flight.igc")
+	points := airborneTrack(track, airborneSegments(track.Points)).Points
+	at := func(h, m, s int) time.Time { return time.Date(2018, 8, 16, h, m, s, 0, time.UTC) }
+
+	// the triangle is flown through both turnpoints, but the landing is
+	// about a kilometre short of the finish
+	result := verifyTask(points, declaredTask(track.Task, defaultZones), defaultZones)
+	if result.Completed || len(result.Missed) != 1 || result.Missed[0] != "FINISH" {
+		t.Errorf("Expected the finish to be missed, got %v", result.Missed)
+	}
+	if result.Distance < 31 || result.Distance > 33 {
+		t.Errorf("Expected a task of about 32km, got %.2f", result.Distance)
+	}
+	expected := []struct {
+		from, to time.Time
+	}{
+		{at(10, 3, 0), at(10, 4, 0)},
+		{at(10, 25, 0), at(10, 28, 0)},
+		{at(10, 49, 0), at(10, 52, 0)},
+	}
+	for i, want := range expected {
+		p := result.Points[i]
+		if !p.Reached || p.Time == nil || p.Time.Before(want.from) || p.Time.After(want.to) {
+			t.Errorf("Expected %s reached between %v and %v, got %v", p.Name, want.from, want.to, p.Time)
+		}
+	}
+
+	// larger cylinders take the finish, and the start is the exit of the
+	// cylinder after the first thermal
+	zones := defaultZones
+	zones.Radius = 1500
+	result = verifyTask(points, declaredTask(track.Task, zones), zones)
+	if !result.Completed || len(result.Missed) != 0 {
+		t.Fatalf("Expected the task completed, missed %v", result.Missed)
+	}
+	if start := *result.Points[0].Time; start.Before(at(10, 11, 0)) || start.After(at(10, 14, 0)) {
+		t.Errorf("Expected the last start after the first thermal, got %v", start)
+	}
+	if result.Duration < 3000 || result.Duration > 3600 {
+		t.Errorf("Expected about 3400 seconds from start to finish, got %d", result.Duration)
+	}
+	if result.Speed < 30 || result.Speed > 38 {
+		t.Errorf("Expected a task speed about 34km/h, got %.1f", result.Speed)
+	}
+
+	// sectors are reached when entering the thermals, the start line is
+	// crossed on the glide out of launch
+	zones = taskZones{Turnpoint: zoneSector, Start: zoneLine, Finish: zoneLine, Radius: 400, LineLength: 1000}
+	result = verifyTask(points, declaredTask(track.Task, zones), zones)
+	for i, want := range []time.Time{at(10, 3, 0), at(10, 27, 9), at(10, 51, 18)} {
+		p := result.Points[i]
+		if !p.Reached || p.Time == nil || p.Time.Sub(want) > 30*time.Second || want.Sub(*p.Time) > 30*time.Second {
+			t.Errorf("Expected %s reached at %v, got %v", p.Name, want, p.Time)
+		}
+	}
+	if result.Points[3].Reached {
+		t.Errorf("Expected the finish line not to be crossed")
+	}
+}
+
+func TestVerifyTaskWithoutTurnpoints(t *testing.T) {
+	// 10 minutes north at 10 m/s, then back to the start
+	points := syntheticTrack([3]float64{600, 10, 0}, [3]float64{600, -10, 0})
+	home := igc.NewPointFromLatLng(46, 8)
+	home.Description = "HOME"
+
+	if task := declaredTask(igc.Task{}, defaultZones); task != nil {
+		t.Errorf("Expected no task without a declaration, got %v", task)
+	}
+
+	// out and back from the start, leaving its cylinder after 40 seconds
+	task := declaredTask(igc.Task{Start: home, Finish: home}, defaultZones)
+	if len(task) != 2 {
+		t.Fatalf("Expected the start and finish, got %v", task)
+	}
+	result := verifyTask(points, task, defaultZones)
+	if !result.Completed || result.Duration < 1100 || result.Duration > 1140 {
+		t.Errorf("Expected the return to finish after about 1120 seconds, got %+v", result)
+	}
+
+	// from the start to a goal 3km north, reached 400m before it
+	goal := igc.NewPointFromLatLng(46+3000.0/111195, 8)
+	result = verifyTask(points, declaredTask(igc.Task{Start: home, Finish: goal}, defaultZones), defaultZones)
+	if !result.Completed || result.Distance < 2.9 || result.Distance > 3.1 || result.Duration < 200 || result.Duration > 240 {
+		t.Errorf("Expected the 3km goal reached about 220 seconds after the start, got %+v", result)
+	}
+}
+
+func TestVerifyTaskLineDirection(t *testing.T) {
+	// 10 minutes north at 10 m/s
+	points := syntheticTrack([3]float64{600, 10, 0})
+	near := igc.NewPointFromLatLng(46+1000.0/111195, 8)
+	near.Description = "NEAR"
+	far := igc.NewPointFromLatLng(46+3000.0/111195, 8)
+	far.Description = "FAR"
+	zones := taskZones{Turnpoint: zoneCylinder, Start: zoneLine, Finish: zoneLine, Radius: 400, LineLength: 1000}
+
+	result := verifyTask(points, declaredTask(igc.Task{Start: near, Finish: far}, zones), zones)
+	if !result.Completed || result.Duration != 200 {
+		t.Errorf("Expected the lines crossed 200 seconds apart, got %+v", result)
+	}
+
+	// the same lines flown the wrong way are not crossed
+	result = verifyTask(points, declaredTask(igc.Task{Start: far, Finish: near}, zones), zones)
+	if result.Completed || len(result.Missed) != 2 {
+		t.Errorf("Expected both lines missed, got %+v", result)
+	}
+}
+
+func TestZonesFromQuery(t *testing.T) {
+	zones, err := zonesFromQuery(url.Values{"zone": {"sector"}, "finish": {"line"}, "line_length": {"2000"}})
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	want := taskZones{Turnpoint: zoneSector, Start: zoneCylinder, Finish: zoneLine, Radius: 400, LineLength: 2000}
+	if zones != want {
+		t.Errorf("Expected %+v, got %+v", want, zones)
+	}
+
+	for _, query := range []url.Values{
+		{"zone": {"line"}},
+		{"start": {"sector"}},
+		{"radius": {"-5"}},
+		{"line_length": {"far"}},
+	} {
+		if _, err := zonesFromQuery(query); err == nil {
+			t.Errorf("Expected an error for %v", query)
+		}
+	}
+}
+
+func TestTrackTask(t *testing.T) {
+	srv := newTestServer()
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	id := uploadFlight(t, ts.URL, "testdata/flight.igc")
+	taskURL := ts.URL + root + "/api/track/" + strconv.Itoa(id) + "/task"
+
+	resp, err := http.Get(taskURL + "?radius=1500")
+	if err != nil {
+		t.Fatalf("Error creating the GET request, %s", err)
+	}
+	result := map[string]interface{}{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Error decoding task, %s", err)
+	}
+	if result["completed"] != true {
+		t.Errorf("Expected the task completed, got %v", result)
+	}
+	for _, field := range []string{"distance", "duration", "speed", "points", "missed"} {
+		if _, ok := result[field]; !ok {
+			t.Errorf("Expected %s in the task", field)
+		}
+	}
+
+	resp, err = http.Get(taskURL + "?zone=circle")
+	if err != nil {
+		t.Fatalf("Error creating the GET request, %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown zone, got %d", resp.StatusCode)
+	}
+
+	// the same flight without its declaration
+	content, _ := ioutil.ReadFile("testdata/flight.igc")
+	content = regexp.MustCompile(`(?m)^C.*\r?\n`).ReplaceAll(content, nil)
+	other := httptest.NewServer(newTestServer().routes())
+	defer other.Close()
+	resp, err = http.Post(other.URL+root+"/api/track", "text/plain", bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("Error creating the POST request, %s", err)
+	}
+	created := resID{}
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Error decoding response, %s", err)
+	}
+	resp, err = http.Get(other.URL + root + "/api/track/" + strconv.Itoa(created.TrackID) + "/task")
+	if err != nil {
+		t.Fatalf("Error creating the GET request, %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 without a declared task, got %d", resp.StatusCode)
+	}
+}
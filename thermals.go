@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/golang/geo/s2"
+	"github.com/marni/goigc"
+)
+
+// thresholds of the thermal detector
+const (
+	// a fix is circling while the heading turns faster than this over
+	// rateWindow, in deg/s: a full turn in a minute
+	minTurnRate = 6.0
+	// shorter straight stretches don't end a thermal, e.g. when the pilot
+	// recentres
+	maxRecentre = 20 * time.Second
+	// circling that doesn't add up to a full turn is not a thermal
+	minCircling = 360.0
+)
+
+// thermal is a circling part of a flight. Altitudes are in metres and
+// the climb in m/s.
+type thermal struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Duration  int       `json:"duration"` // seconds
+	Lat       float64   `json:"lat"`      // centre, in degrees
+	Lng       float64   `json:"lng"`
+	EntryAlt  float64   `json:"entry_alt"`
+	ExitAlt   float64   `json:"exit_alt"`
+	AvgClimb  float64   `json:"avg_climb"`
+	Direction string    `json:"direction"` // "left" or "right"
+
+	// indexes of the first and last fix in the track
+	first, last int
+}
+
+// Finds the thermals of the flights. A fix is circling while the heading
+// turns faster than minTurnRate, and circling stretches separated by less
+// than maxRecentre are one thermal if they turn a full circle.
+func detectThermals(points []igc.Point, flights []flightSegment) []thermal {
+	thermals := make([]thermal, 0)
+	alt := altitudes(points)
+
+	for _, f := range flights {
+		flight := points[f.Takeoff : f.Landing+1]
+		turns := headingChanges(flight)
+
+		circling := make([]bool, len(flight))
+		for i := range flight {
+			from, to := turnSpan(flight, i)
+			seconds := flight[to].Time.Sub(flight[from].Time).Seconds()
+			if seconds <= 0 {
+				continue
+			}
+			turned := 0.0
+			for _, t := range turns[from+1 : to+1] {
+				turned += t
+			}
+			circling[i] = math.Abs(turned)/seconds >= minTurnRate
+		}
+
+		for i := 0; i < len(flight); i++ {
+			if !circling[i] {
+				continue
+			}
+			start, end := i, i
+			for j := i + 1; j < len(flight); j++ {
+				if flight[j].Time.Sub(flight[end].Time) > maxRecentre {
+					break
+				}
+				if circling[j] {
+					end = j
+				}
+			}
+			i = end
+
+			turned := 0.0
+			for _, t := range turns[start+1 : end+1] {
+				turned += t
+			}
+			if math.Abs(turned) < minCircling {
+				continue
+			}
+			first, last := settleThermal(flight, alt[f.Takeoff:f.Landing+1], start, end)
+			thermals = append(thermals, newThermal(points, alt, f.Takeoff+first, f.Takeoff+last, turned))
+		}
+	}
+	return thermals
+}
+
+// Returns the span of fixes the turn rate at fix i is measured over:
+// rateWindow centred on i, clipped to the flight
+func turnSpan(points []igc.Point, i int) (int, int) {
+	from, to := i, i
+	for from > 0 && points[i].Time.Sub(points[from-1].Time) <= rateWindow/2 {
+		from--
+	}
+	for to+1 < len(points) && points[to+1].Time.Sub(points[i].Time) <= rateWindow/2 {
+		to++
+	}
+	return from, to
+}
+
+// The turn rate blurs the ends of a thermal over rateWindow. Moves its
+// first fix to the lowest and its last fix to the highest within half a
+// rateWindow, where the climb really starts and ends.
+func settleThermal(points []igc.Point, alt []float64, first, last int) (int, int) {
+	entry, exit := first, last
+	for i := first - 1; i >= 0 && points[first].Time.Sub(points[i].Time) <= rateWindow/2; i-- {
+		if alt[i] < alt[entry] {
+			entry = i
+		}
+	}
+	for i := last + 1; i < len(points) && points[i].Time.Sub(points[last].Time) <= rateWindow/2; i++ {
+		if alt[i] > alt[exit] {
+			exit = i
+		}
+	}
+	return entry, exit
+}
+
+// Returns the signed heading change at every fix, in degrees, clockwise
+// positive. The heading at a fix is the bearing to the next one, and it is
+// kept while the glider doesn't move.
+func headingChanges(points []igc.Point) []float64 {
+	turns := make([]float64, len(points))
+	heading, known := 0.0, false
+	for i := 0; i+1 < len(points); i++ {
+		if points[i].LatLng == points[i+1].LatLng {
+			continue
+		}
+		h := bearing(points[i].LatLng, points[i+1].LatLng)
+		if known {
+			turns[i] = headingChange(heading, h)
+		}
+		heading, known = h, true
+	}
+	return turns
+}
+
+// Describes the circling from fix first to fix last, which turned the
+// given degrees
+func newThermal(points []igc.Point, alt []float64, first, last int, turned float64) thermal {
+	// the centre is the mean of the fixes, on the sphere
+	var sum s2.Point
+	for _, p := range points[first : last+1] {
+		sum = s2.Point{Vector: sum.Add(s2.PointFromLatLng(p.LatLng).Vector)}
+	}
+	centre := s2.LatLngFromPoint(sum)
+
+	t := thermal{
+		Start:     points[first].Time,
+		End:       points[last].Time,
+		Lat:       centre.Lat.Degrees(),
+		Lng:       centre.Lng.Degrees(),
+		EntryAlt:  alt[first],
+		ExitAlt:   alt[last],
+		Direction: "right",
+		first:     first,
+		last:      last,
+	}
+	if turned < 0 {
+		t.Direction = "left"
+	}
+
+	seconds := points[last].Time.Sub(points[first].Time).Seconds()
+	t.Duration = int(seconds)
+	if seconds > 0 {
+		t.AvgClimb = (t.ExitAlt - t.EntryAlt) / seconds
+	}
+	return t
+}
+
+// Returns the share of the airborne seconds spent circling, in percent,
+// and the average climb rate over all thermals
+func summarizeThermals(thermals []thermal, airborne int) (float64, float64) {
+	circling, gained := 0, 0.0
+	for _, t := range thermals {
+		circling += t.Duration
+		gained += t.ExitAlt - t.EntryAlt
+	}
+
+	percent, climb := 0.0, 0.0
+	if airborne > 0 {
+		percent = 100 * float64(circling) / float64(airborne)
+	}
+	if circling > 0 {
+		climb = gained / float64(circling)
+	}
+	return percent, climb
+}
+
+// Initial great circle bearing from a to b, in degrees clockwise from north
+func bearing(a, b s2.LatLng) float64 {
+	dLng := (b.Lng - a.Lng).Radians()
+	y := math.Sin(dLng) * math.Cos(b.Lat.Radians())
+	x := math.Cos(a.Lat.Radians())*math.Sin(b.Lat.Radians()) -
+		math.Sin(a.Lat.Radians())*math.Cos(b.Lat.Radians())*math.Cos(dLng)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+// Signed change from heading a to heading b, in degrees between -180 and
+// 180, clockwise positive
+func headingChange(a, b float64) float64 {
+	return math.Mod(b-a+540, 360) - 180
+}
+
+// GET api/track/<id>/thermals lists the thermals of the track
+func (s *server) thermalsHandler(w http.ResponseWriter, r *http.Request, fields igcFields) {
+	track, ok := s.loadTrack(w, fields)
+	if !ok {
+		return
+	}
+	thermals := detectThermals(track.Points, airborneSegments(track.Points))
+
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(&thermals); err != nil {
+		status := 500
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDetectThermals(t *testing.T) {
+	track := parseTestFlight(t, "testdata/flight.igc")
+	thermals := detectThermals(track.Points, airborneSegments(track.Points))
+
+	// 8 minutes of right turns at 2.5m/s, 9 minutes of left turns at
+	// 2m/s and 3 minutes of right turns at 2.5m/s
+	expected := []struct {
+		start     time.Time
+		duration  int
+		climb     float64
+		direction string
+	}{
+		{time.Date(2018, 8, 16, 10, 4, 0, 0, time.UTC), 480, 2.5, "right"},
+		{time.Date(2018, 8, 16, 10, 27, 9, 0, time.UTC), 540, 2.0, "left"},
+		{time.Date(2018, 8, 16, 10, 51, 18, 0, time.UTC), 180, 2.5, "right"},
+	}
+	if len(thermals) != len(expected) {
+		t.Fatalf("Expected %d thermals, got %d", len(expected), len(thermals))
+	}
+	for i, want := range expected {
+		got := thermals[i]
+		if !closeInTime(got.Start, want.start, 15*time.Second) {
+			t.Errorf("Thermal %d: expected start at %v, got %v", i, want.start, got.Start)
+		}
+		if got.Duration < want.duration-20 || got.Duration > want.duration+20 {
+			t.Errorf("Thermal %d: expected %d seconds, got %d", i, want.duration, got.Duration)
+		}
+		if got.AvgClimb < want.climb-0.3 || got.AvgClimb > want.climb+0.3 {
+			t.Errorf("Thermal %d: expected climb about %.1fm/s, got %.2f", i, want.climb, got.AvgClimb)
+		}
+		if got.Direction != want.direction {
+			t.Errorf("Thermal %d: expected %s turns, got %s", i, want.direction, got.Direction)
+		}
+		if got.ExitAlt <= got.EntryAlt {
+			t.Errorf("Thermal %d: expected to exit higher than %.0fm, got %.0fm", i, got.EntryAlt, got.ExitAlt)
+		}
+	}
+
+	// the first thermal drifts from near the launch
+	if d := (thermals[0].Lat-46.0027)*(thermals[0].Lat-46.0027) + (thermals[0].Lng-8.009)*(thermals[0].Lng-8.009); d > 0.01*0.01 {
+		t.Errorf("Unexpected centre %f,%f for the first thermal", thermals[0].Lat, thermals[0].Lng)
+	}
+
+	percent, climb := summarizeThermals(thermals, computeStats(track.Points, airborneSegments(track.Points)).Duration)
+	if percent < 27 || percent > 32 {
+		t.Errorf("Expected about 30%% circling, got %.1f", percent)
+	}
+	if climb < 2.0 || climb > 2.4 {
+		t.Errorf("Expected about 2.2m/s average climb, got %.2f", climb)
+	}
+}
+
+func TestDetectThermalsStraight(t *testing.T) {
+	// straight glides and a straight climb in ridge lift
+	points := syntheticTrack([3]float64{120, 10, -1}, [3]float64{300, 8, 1.5}, [3]float64{120, 10, -1})
+	thermals := detectThermals(points, airborneSegments(points))
+	if len(thermals) != 0 {
+		t.Errorf("Expected no thermals, got %d", len(thermals))
+	}
+}
+
+func TestTrackThermals(t *testing.T) {
+	srv := newTestServer()
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	id := uploadFlight(t, ts.URL, "testdata/flight.igc")
+	resp, err := http.Get(ts.URL + root + "/api/track/" + strconv.Itoa(id) + "/thermals")
+	if err != nil {
+		t.Fatalf("Error creating the GET request, %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the thermals, got %d", resp.StatusCode)
+	}
+	thermals := []map[string]interface{}{}
+	if err = json.NewDecoder(resp.Body).Decode(&thermals); err != nil {
+		t.Fatalf("Error decoding thermals, %s", err)
+	}
+	if len(thermals) != 3 {
+		t.Fatalf("Expected 3 thermals, got %d", len(thermals))
+	}
+	for _, field := range []string{"start", "end", "duration", "lat", "lng", "entry_alt", "exit_alt", "avg_climb", "direction"} {
+		if _, ok := thermals[0][field]; !ok {
+			t.Errorf("Expected %s in the thermal", field)
+		}
+	}
+
+	fields, err := srv.store.Get(id)
+	if err != nil {
+		t.Fatalf("Error loading track, %s", err)
+	}
+	if fields.CirclingPercent < 27 || fields.CirclingPercent > 32 {
+		t.Errorf("Expected about 30%% circling, got %.1f", fields.CirclingPercent)
+	}
+	if fields.AvgClimb < 2.0 || fields.AvgClimb > 2.4 {
+		t.Errorf("Expected about 2.2m/s average climb, got %.2f", fields.AvgClimb)
+	}
+}